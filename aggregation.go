@@ -0,0 +1,29 @@
+package main
+
+import "math"
+
+// aggregation describes how the values of a metric of several databases (or
+// pools) are combined into the "Across all instances" totals.
+type aggregation int
+
+const (
+	aggregateSum aggregation = iota
+	aggregateMax
+	aggregateWeightedAverage
+)
+
+// aggregate combines the values a and b. The weights wa and wb are only
+// used for aggregateWeightedAverage.
+func (agg aggregation) aggregate(a, wa, b, wb float64) float64 {
+	switch agg {
+	case aggregateMax:
+		return math.Max(a, b)
+	case aggregateWeightedAverage:
+		if wa+wb == 0 {
+			return 0
+		}
+		return (a*wa + b*wb) / (wa + wb)
+	default:
+		return a + b
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregation(t *testing.T) {
+	assert.Equal(t, float64(5), aggregateSum.aggregate(2, 0, 3, 0))
+	assert.Equal(t, float64(3), aggregateMax.aggregate(2, 0, 3, 0))
+	assert.Equal(t, float64(4), aggregateWeightedAverage.aggregate(2, 1, 5, 2))
+	assert.Equal(t, float64(0), aggregateWeightedAverage.aggregate(2, 0, 5, 0))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// minQueryTimeJump is the smallest increase of the average query time in
+// milliseconds which triggers a burst, ignoring jumps of very fast queries.
+const minQueryTimeJump = 1.0
+
+// burstConfig configures the switch to a short, high-resolution interval
+// while pools are under pressure.
+type burstConfig struct {
+	interval      time.Duration
+	duration      time.Duration
+	maxWait       float64
+	queryTimeJump float64
+}
+
+// burstState tracks the active burst, only used by the main loop.
+type burstState struct {
+	until time.Time
+}
+
+var burst burstState
+
+func (b *burstState) active(now time.Time) bool {
+	return now.Before(b.until)
+}
+
+// burstTrigger returns why the target requires a burst, empty when it is
+// healthy. The average query time of the last interval is kept on the
+// target as the baseline of the next interval.
+func (t *target) burstTrigger(config burstConfig) string {
+	previous, current := t.status.previous, t.status.current
+	if current == nil {
+		return ""
+	}
+
+	if total, ok := current.pools[poolKey{}]; ok {
+		if total.ClientsWaiting > 0 {
+			return fmt.Sprintf("%v clients waiting", total.ClientsWaiting)
+		}
+		if config.maxWait > 0 && total.maxWaitSeconds() > config.maxWait {
+			return fmt.Sprintf("clients waiting for %.1fs", total.maxWaitSeconds())
+		}
+	}
+
+	if previous == nil {
+		return ""
+	}
+	deltas, reset := statsDelta(*previous, *current)
+	total, ok := deltas[""]
+	if !ok || reset {
+		return ""
+	}
+	baseline := t.queryTime
+	t.queryTime = total.QueryTime
+	if config.queryTimeJump > 0 && baseline > 0 &&
+		total.QueryTime > baseline*config.queryTimeJump && total.QueryTime-baseline >= minQueryTimeJump {
+		return fmt.Sprintf("query time jumped from %.1fms to %.1fms", baseline, total.QueryTime)
+	}
+	return ""
+}
+
+// checkBurst starts or extends the burst when any of the targets triggers
+// it.
+func checkBurst(targets []*target, now time.Time) {
+	config := metadata.burst
+	if config.interval <= 0 {
+		return
+	}
+
+	for _, t := range targets {
+		reason := t.burstTrigger(config)
+		if reason == "" {
+			continue
+		}
+		if !burst.active(now) {
+			t.logf("Switching to a %s interval for %s: %s", config.interval, config.duration, reason)
+		}
+		burst.until = now.Add(config.duration)
+	}
+}
+
+// interval returns the interval until the next run, the burst interval
+// while a burst is active.
+func (b *burstState) interval(interval time.Duration, now time.Time) time.Duration {
+	if b.active(now) {
+		return metadata.burst.interval
+	}
+	if !b.until.IsZero() {
+		log.Printf("Pressure is gone, switching back to a %s interval", interval)
+		b.until = time.Time{}
+	}
+	return interval
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func burstPoint(timestamp time.Time, queryCount float64, queryTime float64, pool Pool) *statusPoint {
+	return &statusPoint{
+		stats: DBStats{
+			"test_1": Stats{Database: "test_1", QueryCount: queryCount, QueryTime: queryTime, TimeStamp: timestamp},
+		},
+		pools: DBPools{poolKey{}: pool},
+	}
+}
+
+func TestBurstTrigger(t *testing.T) {
+	config := burstConfig{interval: time.Second, duration: time.Minute, maxWait: 1, queryTimeJump: 2}
+	start := time.Now()
+	target := &target{}
+
+	// 1000 queries of 2ms
+	target.status.previous = burstPoint(start, 0, 0, Pool{})
+	target.status.current = burstPoint(start.Add(time.Minute), 1000, 2000000, Pool{})
+	assert.Equal(t, "", target.burstTrigger(config))
+	assert.Equal(t, float64(2), target.queryTime)
+
+	// 1000 queries of 5ms
+	target.status.previous = target.status.current
+	target.status.current = burstPoint(start.Add(2*time.Minute), 2000, 7000000, Pool{})
+	assert.Equal(t, "query time jumped from 2.0ms to 5.0ms", target.burstTrigger(config))
+
+	target.status.current.pools[poolKey{}] = Pool{ClientsWaiting: 3}
+	assert.Equal(t, "3 clients waiting", target.burstTrigger(config))
+
+	target.status.current.pools[poolKey{}] = Pool{MaxWait: 1, MaxWaitUs: 500000}
+	assert.Equal(t, "clients waiting for 1.5s", target.burstTrigger(config))
+
+	target.status.current = nil
+	assert.Equal(t, "", target.burstTrigger(config))
+}
+
+func TestBurstInterval(t *testing.T) {
+	defer func(old burstConfig) { metadata.burst = old }(metadata.burst)
+	metadata.burst = burstConfig{interval: time.Second, duration: time.Minute}
+	defer func() { burst = burstState{} }()
+
+	now := time.Now()
+	healthy := &target{}
+	healthy.status.current = burstPoint(now, 0, 0, Pool{})
+	checkBurst([]*target{healthy}, now)
+	assert.Equal(t, 60*time.Second, burst.interval(60*time.Second, now))
+
+	waiting := &target{}
+	waiting.status.current = burstPoint(now, 0, 0, Pool{ClientsWaiting: 1})
+	checkBurst([]*target{healthy, waiting}, now)
+	assert.Equal(t, time.Second, burst.interval(60*time.Second, now.Add(30*time.Second)))
+	assert.Equal(t, 60*time.Second, burst.interval(60*time.Second, now.Add(time.Minute)))
+	assert.True(t, burst.until.IsZero())
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	clientIPv4PrefixLength = 24
+	clientIPv6PrefixLength = 64
+	clientOtherGroup       = "other"
+)
+
+type Client struct {
+	User            string  `db:"user"`
+	Database        string  `db:"database"`
+	State           string  `db:"state"`
+	Addr            string  `db:"addr"`
+	ApplicationName string  `db:"application_name"`
+	Wait            float64 `db:"wait"`
+	WaitUs          float64 `db:"wait_us"`
+	// The number of prepared statements of the client, since pgbouncer 1.21
+	PreparedStatements float64 `db:"prepared_statements"`
+}
+
+// clientGroupKey identifies a group of client connections, the address is
+// truncated to its subnet to limit the number of groups.
+type clientGroupKey struct {
+	ApplicationName string
+	User            string
+	Subnet          string
+}
+
+type ClientGroup struct {
+	clientGroupKey
+	Connections float64
+	Waiting     float64
+	OldestWait  float64
+	// The number of prepared statements of the clients in the group
+	PreparedStatements float64
+	TimeStamp          time.Time
+}
+
+func (g *ClientGroup) add(c Client) {
+	g.Connections++
+	g.PreparedStatements += c.PreparedStatements
+	if c.State == "waiting" {
+		g.Waiting++
+		g.OldestWait = math.Max(g.OldestWait, c.Wait+c.WaitUs/1000000)
+	}
+}
+
+func (g *ClientGroup) merge(o ClientGroup) {
+	g.Connections += o.Connections
+	g.Waiting += o.Waiting
+	g.PreparedStatements += o.PreparedStatements
+	g.OldestWait = math.Max(g.OldestWait, o.OldestWait)
+}
+
+func (g *ClientGroup) addMetricData(dest []Metric) []Metric {
+	dimensions := []Dimension{
+		{Name: "ApplicationName", Value: g.ApplicationName},
+		{Name: "User", Value: g.User},
+		{Name: "ClientSubnet", Value: g.Subnet},
+	}
+	return append(dest,
+		newMetric("ClientConnections", g.Connections, UnitCount, g.TimeStamp, dimensions...),
+		newMetric("ClientConnectionsWaiting", g.Waiting, UnitCount, g.TimeStamp, dimensions...),
+		newMetric("ClientOldestWait", g.OldestWait, UnitSeconds, g.TimeStamp, dimensions...),
+		newMetric("ClientPreparedStatements", g.PreparedStatements, UnitCount, g.TimeStamp, dimensions...))
+}
+
+// clientSubnet returns the subnet of the client address, unix socket
+// connections are returned as is.
+func clientSubnet(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(clientIPv4PrefixLength, 32)
+		network := net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+		return network.String()
+	}
+	mask := net.CIDRMask(clientIPv6PrefixLength, 128)
+	network := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return network.String()
+}
+
+// groupClients groups the clients by application name, user and subnet.
+// Only the maxGroups largest groups are kept, the others are merged into a
+// single "other" group.
+func groupClients(clients []Client, maxGroups int, timestamp time.Time) []ClientGroup {
+	groups := make(map[clientGroupKey]*ClientGroup)
+	for _, client := range clients {
+		if client.Database == "pgbouncer" {
+			continue
+		}
+		key := clientGroupKey{
+			ApplicationName: client.ApplicationName,
+			User:            client.User,
+			Subnet:          clientSubnet(client.Addr),
+		}
+		if key.ApplicationName == "" {
+			key.ApplicationName = "unknown"
+		}
+		group, ok := groups[key]
+		if !ok {
+			group = &ClientGroup{clientGroupKey: key, TimeStamp: timestamp}
+			groups[key] = group
+		}
+		group.add(client)
+	}
+
+	result := make([]ClientGroup, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, *group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Connections != result[j].Connections {
+			return result[i].Connections > result[j].Connections
+		}
+		a, b := result[i].clientGroupKey, result[j].clientGroupKey
+		if a.ApplicationName != b.ApplicationName {
+			return a.ApplicationName < b.ApplicationName
+		}
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		return a.Subnet < b.Subnet
+	})
+
+	if maxGroups <= 0 || len(result) <= maxGroups {
+		return result
+	}
+
+	// Reserve one group for the remaining clients
+	keep := maxGroups - 1
+	other := ClientGroup{
+		clientGroupKey: clientGroupKey{clientOtherGroup, clientOtherGroup, clientOtherGroup},
+		TimeStamp:      timestamp,
+	}
+	for _, group := range result[keep:] {
+		other.merge(group)
+	}
+	return append(result[:keep], other)
+}
+
+func getClientData(ctx context.Context, db *sqlx.DB) ([]ClientGroup, error) {
+	var clients []Client
+	// The columns differ between pgbouncer versions, application_name is
+	// only available in recent versions.
+	err := selectContext(ctx, db.Unsafe(), &clients, `SHOW CLIENTS`)
+	if err != nil {
+		return nil, err
+	}
+	return groupClients(clients, metadata.clientsMaxGroups, time.Now()), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestGetClientData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{
+		"type", "user", "database", "state", "addr", "port", "wait", "wait_us", "application_name",
+	}).
+		AddRow("C", "app", "test_1", "active", "10.0.1.5", 50000, 0, 0, "api").
+		AddRow("C", "app", "test_1", "waiting", "10.0.1.6", 50001, 1, 500000, "api").
+		AddRow("C", "app", "test_1", "waiting", "10.0.2.6", 50002, 3, 0, "api").
+		AddRow("C", "worker", "test_1", "active", "unix", 6432, 0, 0, "").
+		AddRow("C", "pgbouncer", "pgbouncer", "active", "unix", 6432, 0, 0, "pgbouncer-cw")
+	mock.ExpectQuery("SHOW CLIENTS").WillReturnRows(rows)
+
+	groups, err := getClientData(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+
+	timestamp := groups[0].TimeStamp
+	expected := []ClientGroup{
+		{
+			clientGroupKey: clientGroupKey{"api", "app", "10.0.1.0/24"},
+			Connections:    2,
+			Waiting:        1,
+			OldestWait:     1.5,
+			TimeStamp:      timestamp,
+		},
+		{
+			clientGroupKey: clientGroupKey{"api", "app", "10.0.2.0/24"},
+			Connections:    1,
+			Waiting:        1,
+			OldestWait:     3,
+			TimeStamp:      timestamp,
+		},
+		{
+			clientGroupKey: clientGroupKey{"unknown", "worker", "unix"},
+			Connections:    1,
+			TimeStamp:      timestamp,
+		},
+	}
+	assert.Equal(t, expected, groups)
+}
+
+func TestGroupClientsMaxGroups(t *testing.T) {
+	clients := []Client{
+		{User: "a", Addr: "10.0.0.1", ApplicationName: "api"},
+		{User: "a", Addr: "10.0.0.2", ApplicationName: "api"},
+		{User: "b", Addr: "10.0.0.1", ApplicationName: "worker", State: "waiting", Wait: 2},
+		{User: "c", Addr: "10.0.0.1", ApplicationName: "cron", State: "waiting", Wait: 4},
+	}
+
+	groups := groupClients(clients, 2, time.Now())
+
+	assert.Equal(t, 2, len(groups))
+	assert.Equal(t, clientGroupKey{"api", "a", "10.0.0.0/24"}, groups[0].clientGroupKey)
+	assert.Equal(t, clientGroupKey{"other", "other", "other"}, groups[1].clientGroupKey)
+	assert.Equal(t, float64(2), groups[1].Connections)
+	assert.Equal(t, float64(2), groups[1].Waiting)
+	assert.Equal(t, float64(4), groups[1].OldestWait)
+}
+
+func TestClientSubnet(t *testing.T) {
+	assert.Equal(t, "192.168.10.0/24", clientSubnet("192.168.10.42"))
+	assert.Equal(t, "2001:db8:1:2::/64", clientSubnet("2001:db8:1:2:3:4:5:6"))
+	assert.Equal(t, "unix", clientSubnet("unix"))
+}
+
+func TestGroupClientsPreparedStatements(t *testing.T) {
+	clients := []Client{
+		{User: "a", Addr: "10.0.0.1", ApplicationName: "api", PreparedStatements: 4},
+		{User: "a", Addr: "10.0.0.2", ApplicationName: "api", PreparedStatements: 6},
+	}
+
+	groups := groupClients(clients, 0, time.Now())
+	assert.Equal(t, float64(10), groups[0].PreparedStatements)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+)
+
+// cloudWatchBatchSize is the maximum number of metrics accepted by a single
+// PutMetricData call.
+const cloudWatchBatchSize = 20
+
+type cloudWatchSink struct {
+	svc       *cloudwatch.CloudWatch
+	namespace string
+}
+
+func newCloudWatchSink(cfg sinkConfig) (Sink, error) {
+	return &cloudWatchSink{
+		svc:       cloudwatch.New(cfg.aws),
+		namespace: cfg.namespace,
+	}, nil
+}
+
+func (c *cloudWatchSink) Name() string {
+	return "cloudwatch"
+}
+
+func (c *cloudWatchSink) Push(metrics []Metric) error {
+	log.Printf(
+		"Pushing %d metrics to CloudWatch Metrics (InstanceID '%s')\n",
+		len(metrics), metadata.InstanceID)
+
+	data := make([]cloudwatch.MetricDatum, len(metrics))
+	for i, metric := range metrics {
+		data[i] = createMetricDatum(metric)
+	}
+
+	var lastErr error
+	for i := 0; i < len(data); i += cloudWatchBatchSize {
+		request := c.svc.PutMetricDataRequest(&cloudwatch.PutMetricDataInput{
+			MetricData: data[i:min(i+cloudWatchBatchSize, len(data))],
+			Namespace:  &c.namespace,
+		})
+		_, err := request.Send()
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func createMetricDatum(metric Metric) cloudwatch.MetricDatum {
+	dimensions := make([]cloudwatch.Dimension, len(metric.Dimensions))
+	for i, dimension := range metric.Dimensions {
+		dimensions[i] = cloudwatch.Dimension{
+			Name:  stringPtr(dimension.Name),
+			Value: stringPtr(dimension.Value),
+		}
+	}
+
+	timestamp := metric.TimeStamp
+	datum := cloudwatch.MetricDatum{
+		MetricName: stringPtr(metric.Name),
+		Dimensions: dimensions,
+		Timestamp:  &timestamp,
+		Unit:       cloudwatch.StandardUnit(metric.Unit),
+	}
+
+	if metric.HighResolution {
+		datum.StorageResolution = aws.Int64(1)
+	}
+
+	// Value and StatisticValues are mutually exclusive
+	if s := metric.Statistics; s != nil {
+		datum.StatisticValues = &cloudwatch.StatisticSet{
+			Minimum:     float64Ptr(s.Minimum),
+			Maximum:     float64Ptr(s.Maximum),
+			Sum:         float64Ptr(s.Sum),
+			SampleCount: float64Ptr(s.SampleCount),
+		}
+	} else {
+		datum.Value = float64Ptr(metric.Value)
+	}
+	return datum
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateMetricDatum(t *testing.T) {
+	timestamp := time.Now()
+	metric := newMetric(
+		"QueryTime", 1.5, UnitMilliseconds, timestamp,
+		Dimension{Name: "Database", Value: "test"})
+
+	expected := cloudwatch.MetricDatum{
+		MetricName: stringPtr("QueryTime"),
+		Dimensions: []cloudwatch.Dimension{
+			{Name: stringPtr("Database"), Value: stringPtr("test")},
+		},
+		Timestamp: &timestamp,
+		Unit:      cloudwatch.StandardUnitMilliseconds,
+		Value:     float64Ptr(1.5),
+	}
+
+	assert.Equal(t, expected, createMetricDatum(metric))
+}
+
+func TestCreateMetricDatumStatistics(t *testing.T) {
+	timestamp := time.Now()
+	metric := newMetric("ClientsWaiting", 2, UnitCount, timestamp)
+	metric.Statistics = &StatisticSet{Minimum: 0, Maximum: 12, Sum: 18, SampleCount: 4}
+
+	expected := cloudwatch.MetricDatum{
+		MetricName: stringPtr("ClientsWaiting"),
+		Dimensions: []cloudwatch.Dimension{},
+		Timestamp:  &timestamp,
+		Unit:       cloudwatch.StandardUnitCount,
+		StatisticValues: &cloudwatch.StatisticSet{
+			Minimum:     float64Ptr(0),
+			Maximum:     float64Ptr(12),
+			Sum:         float64Ptr(18),
+			SampleCount: float64Ptr(4),
+		},
+	}
+
+	assert.Equal(t, expected, createMetricDatum(metric))
+}
+
+func TestCreateMetricDatumHighResolution(t *testing.T) {
+	metrics := markHighResolution([]Metric{
+		newMetric("ClientsWaiting", 2, UnitCount, time.Now()),
+		newMetric("QueryTime", 2, UnitMilliseconds, time.Now()),
+	}, []string{"ClientsWaiting"})
+
+	assert.Equal(t, int64(1), *createMetricDatum(metrics[0]).StorageResolution)
+	assert.Nil(t, createMetricDatum(metrics[1]).StorageResolution)
+
+	metrics = markHighResolution(metrics, []string{"all"})
+	assert.True(t, metrics[1].HighResolution)
+}
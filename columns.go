@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// columnValues holds the values of a single row by column name.
+type columnValues map[string]interface{}
+
+// selectColumns runs the query with the per query timeout and calls fn for
+// every row. The columns differ between pgbouncer versions, selectContext
+// with db.Unsafe() only uses the ones we know. selectColumns doesn't
+// require all columns to be known up front, so columns added by newer
+// pgbouncer versions can still be picked up.
+func selectColumns(ctx context.Context, db *sqlx.DB, query string, fn func(row columnValues)) error {
+	if metadata.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, metadata.queryTimeout)
+		defer cancel()
+	}
+
+	rows, err := db.QueryxContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := make(columnValues)
+		if err := rows.MapScan(row); err != nil {
+			return err
+		}
+		fn(row)
+	}
+	return rows.Err()
+}
+
+// assign sets the fields of dest (a pointer to a struct) to the value of the
+// column matching their db tag. The numeric columns without a matching
+// field are returned, or nil if there are none.
+func (r columnValues) assign(db *sqlx.DB, dest interface{}) map[string]float64 {
+	fields := db.Mapper.FieldMap(reflect.Indirect(reflect.ValueOf(dest)))
+
+	var extra map[string]float64
+	for column, value := range r {
+		field, ok := fields[column]
+		if !ok {
+			if number, ok := columnFloat(value); ok {
+				if extra == nil {
+					extra = make(map[string]float64)
+				}
+				extra[column] = number
+			}
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.Float64:
+			number, _ := columnFloat(value)
+			field.SetFloat(number)
+		case reflect.String:
+			field.SetString(columnString(value))
+		}
+	}
+	return extra
+}
+
+func columnFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case []byte:
+		result, err := strconv.ParseFloat(string(v), 64)
+		return result, err == nil
+	case string:
+		result, err := strconv.ParseFloat(v, 64)
+		return result, err == nil
+	}
+	return 0, false
+}
+
+func columnString(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	if number, ok := columnFloat(value); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	return ""
+}
+
+// addExtra adds the values of src to dest, allocating dest when needed.
+func addExtra(dest map[string]float64, src map[string]float64) map[string]float64 {
+	if len(src) == 0 {
+		return dest
+	}
+	if dest == nil {
+		dest = make(map[string]float64, len(src))
+	}
+	for key, value := range src {
+		dest[key] += value
+	}
+	return dest
+}
+
+// sortedExtraKeys returns the keys of the extra columns in a stable order.
+func sortedExtraKeys(extra map[string]float64) []string {
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// columnMetricName converts a column name to a metric name, for example
+// total_bind_count becomes BindCount.
+func columnMetricName(column string) string {
+	column = strings.TrimPrefix(column, "total_")
+	var result string
+	for _, part := range strings.Split(column, "_") {
+		if part != "" {
+			result += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return result
+}
+
+// isColumnMetricName returns true if name has the form columnMetricName
+// gives the extra columns, e.g. ClientWaitTime.
+func isColumnMetricName(name string) bool {
+	if name == "" || !unicode.IsUpper(rune(name[0])) {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsUpper(r) && !unicode.IsLower(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColumnMetricName(t *testing.T) {
+	assert.Equal(t, "ClientWaitTime", columnMetricName("total_client_wait_time"))
+	assert.Equal(t, "SvBeingCanceled", columnMetricName("sv_being_canceled"))
+
+	assert.True(t, isColumnMetricName(columnMetricName("total_client_wait_time")))
+	assert.True(t, isColumnMetricName("Load1m"))
+	assert.False(t, isColumnMetricName("client_wait_time"))
+	assert.False(t, isColumnMetricName("Client-Wait"))
+	assert.False(t, isColumnMetricName(""))
+}
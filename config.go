@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type configEntry struct {
+	Key   string `db:"key"`
+	Value string `db:"value"`
+}
+
+// PGBouncerConfig holds the settings as reported by SHOW CONFIG.
+type PGBouncerConfig map[string]string
+
+func (c PGBouncerConfig) float(key string) (float64, bool) {
+	value, ok := c[key]
+	if !ok {
+		return 0, false
+	}
+	result, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return result, true
+}
+
+// configChange describes a single setting that changed between scrapes, an
+// empty value means the setting was missing.
+type configChange struct {
+	Key      string
+	Previous string
+	Current  string
+}
+
+func (c PGBouncerConfig) keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// localConfigKeys are the settings which differ between the instances on a
+// host by design, they are left out of the fingerprint.
+var localConfigKeys = []string{
+	"conffile", "listen_addr", "listen_port", "logfile", "peer_id", "pidfile",
+	"service_name", "job_name", "syslog_ident", "unix_socket_dir",
+}
+
+// fingerprint returns a stable hash of the settings, except the local ones
+// and those in metadata.fingerprintExclude. It is truncated to 48 bits so
+// it is represented exactly as a metric value, which makes it possible to
+// alarm when the minimum and maximum differ across instances.
+func (c PGBouncerConfig) fingerprint() float64 {
+	hash := fnv.New64a()
+	for _, key := range c.keys() {
+		if stringInSlice(key, localConfigKeys) || stringInSlice(key, metadata.fingerprintExclude) {
+			continue
+		}
+		hash.Write([]byte(key + "=" + c[key] + "\n"))
+	}
+	return float64(hash.Sum64() >> 16)
+}
+
+// diff returns the settings which differ from previous, sorted by key.
+func (c PGBouncerConfig) diff(previous PGBouncerConfig) []configChange {
+	var changes []configChange
+	for _, key := range c.keys() {
+		if old, ok := previous[key]; !ok || old != c[key] {
+			changes = append(changes, configChange{Key: key, Previous: old, Current: c[key]})
+		}
+	}
+	for _, key := range previous.keys() {
+		if _, ok := c[key]; !ok {
+			changes = append(changes, configChange{Key: key, Previous: previous[key]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// addMetricData adds the ConfigFingerprint metric and, when any setting
+// differs from previous, the ConfigChanged event.
+func (c PGBouncerConfig) addMetricData(dest []Metric, previous PGBouncerConfig, timestamp time.Time) []Metric {
+	if len(c) == 0 {
+		return dest
+	}
+
+	dimensions := []Dimension{
+		{Name: "Across all instances", Value: "instances"},
+		{Name: "InstanceId", Value: metadata.InstanceID},
+	}
+	for _, dimension := range dimensions {
+		dest = append(dest, newMetric("ConfigFingerprint", c.fingerprint(), UnitNone, timestamp, dimension))
+	}
+
+	if len(previous) > 0 && len(c.diff(previous)) > 0 {
+		for _, dimension := range dimensions {
+			dest = append(dest, newMetric("ConfigChanged", 1, UnitCount, timestamp, dimension))
+		}
+	}
+	return dest
+}
+
+// logConfigChanges logs the settings of the target which changed since the
+// previous scrape.
+func (t *target) logConfigChanges() {
+	previous, current := t.status.previous, t.status.current
+	if previous == nil || current == nil || len(previous.config) == 0 || len(current.config) == 0 {
+		return
+	}
+	for _, change := range current.config.diff(previous.config) {
+		t.logf("Setting %s changed from %q to %q", change.Key, change.Previous, change.Current)
+	}
+}
+
+func getConfigData(ctx context.Context, db *sqlx.DB) (PGBouncerConfig, error) {
+	var entries []configEntry
+	// Newer pgbouncer versions return additional columns (default,
+	// changeable) which we don't need.
+	err := selectContext(ctx, db.Unsafe(), &entries, `SHOW CONFIG`)
+	if err != nil {
+		return nil, err
+	}
+
+	config := make(PGBouncerConfig)
+	for _, entry := range entries {
+		config[entry.Key] = entry.Value
+	}
+	return config, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestGetConfigData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"key", "value", "default", "changeable"}).
+		AddRow("listen_port", "6432", "6432", "no").
+		AddRow("max_client_conn", "200", "100", "yes").
+		AddRow("pool_mode", "transaction", "session", "yes")
+	mock.ExpectQuery("SHOW CONFIG").WillReturnRows(rows)
+
+	config, err := getConfigData(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.Equal(t, PGBouncerConfig{
+		"listen_port":     "6432",
+		"max_client_conn": "200",
+		"pool_mode":       "transaction",
+	}, config)
+
+	value, ok := config.float("max_client_conn")
+	assert.True(t, ok)
+	assert.Equal(t, float64(200), value)
+
+	_, ok = config.float("pool_mode")
+	assert.False(t, ok)
+	_, ok = config.float("missing")
+	assert.False(t, ok)
+}
+
+func TestConfigDrift(t *testing.T) {
+	previous := PGBouncerConfig{"default_pool_size": "20", "max_client_conn": "100", "pool_mode": "transaction"}
+	current := PGBouncerConfig{"default_pool_size": "25", "max_client_conn": "100", "listen_port": "6432"}
+
+	assert.Equal(t, previous.fingerprint(), PGBouncerConfig{
+		"pool_mode": "transaction", "max_client_conn": "100", "default_pool_size": "20",
+	}.fingerprint())
+	assert.NotEqual(t, previous.fingerprint(), current.fingerprint())
+	assert.True(t, current.fingerprint() < 1<<48)
+
+	assert.Equal(t, []configChange{
+		{Key: "default_pool_size", Previous: "20", Current: "25"},
+		{Key: "listen_port", Current: "6432"},
+		{Key: "pool_mode", Previous: "transaction"},
+	}, current.diff(previous))
+
+	var names []string
+	for _, metric := range current.addMetricData(nil, previous, time.Now()) {
+		names = append(names, metric.Name)
+	}
+	assert.Equal(t, []string{"ConfigFingerprint", "ConfigFingerprint", "ConfigChanged", "ConfigChanged"}, names)
+
+	assert.Len(t, previous.addMetricData(nil, previous, time.Now()), 2)
+	assert.Len(t, previous.addMetricData(nil, nil, time.Now()), 2)
+}
+
+func TestConfigFingerprintLocalKeys(t *testing.T) {
+	defer func(old []string) { metadata.fingerprintExclude = old }(metadata.fingerprintExclude)
+
+	first := PGBouncerConfig{"default_pool_size": "20", "listen_port": "6432", "pidfile": "/run/a.pid", "dns_zone_check_period": "0"}
+	second := PGBouncerConfig{"default_pool_size": "20", "listen_port": "6433", "pidfile": "/run/b.pid", "dns_zone_check_period": "5"}
+	assert.NotEqual(t, first.fingerprint(), second.fingerprint())
+
+	metadata.fingerprintExclude = []string{"dns_zone_check_period"}
+	assert.Equal(t, first.fingerprint(), second.fingerprint())
+
+	second["default_pool_size"] = "25"
+	assert.NotEqual(t, first.fingerprint(), second.fingerprint())
+}
+
+func TestLogConfigChanges(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	target := &target{Name: "tenant_a"}
+	target.status.previous = &statusPoint{config: PGBouncerConfig{"default_pool_size": "20"}}
+	target.status.current = &statusPoint{config: PGBouncerConfig{"default_pool_size": "25"}}
+	target.logConfigChanges()
+	assert.Contains(t, output.String(), `[tenant_a] Setting default_pool_size changed from "20" to "25"`)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type Database struct {
+	Name               string         `db:"name"`
+	PoolSize           float64        `db:"pool_size"`
+	ReservePool        float64        `db:"reserve_pool"`
+	PoolMode           sql.NullString `db:"pool_mode"`
+	ForceUser          sql.NullString `db:"force_user"`
+	MaxConnections     float64        `db:"max_connections"`
+	CurrentConnections float64        `db:"current_connections"`
+	Paused             float64        `db:"paused"`
+	Disabled           float64        `db:"disabled"`
+	TimeStamp          time.Time
+}
+
+type DBDatabases map[string]Database
+
+// poolUtilization returns the percentage of pool_size used by active
+// server connections of the pool.
+func (d *Database) poolUtilization(pool Pool) float64 {
+	if d.PoolSize <= 0 {
+		return 0
+	}
+	return pool.ServersActive * 100 / d.PoolSize
+}
+
+// reservePoolInUse returns the number of server connections of the pool
+// opened beyond pool_size, which come out of the reserve pool.
+func (d *Database) reservePoolInUse(pool Pool) float64 {
+	servers := pool.ServersActive + pool.ServersIdle + pool.ServersUsed +
+		pool.ServersTested + pool.ServersLogin
+	return math.Max(0, servers-d.PoolSize)
+}
+
+// addMetricData adds the metrics of the database, joined with the pools of
+// the database. pool_size applies to every pool (database and user pair)
+// separately, so the utilization is published per pool and the highest
+// utilization of its pools per database.
+func (d *Database) addMetricData(dest []Metric, pools DBPools) []Metric {
+	dimension := Dimension{Name: "Database", Value: d.Name}
+	dest = append(dest,
+		newMetric("Paused", d.Paused, UnitNone, d.TimeStamp, dimension),
+		newMetric("Disabled", d.Disabled, UnitNone, d.TimeStamp, dimension))
+
+	var found bool
+	var utilization, reserve float64
+	for _, pool := range pools {
+		if pool.IsAggregated || pool.Database != d.Name {
+			continue
+		}
+		found = true
+		poolUtilization := d.poolUtilization(pool)
+		utilization = math.Max(utilization, poolUtilization)
+		reserve += d.reservePoolInUse(pool)
+
+		if d.PoolSize > 0 {
+			dest = append(dest, newMetric(
+				"PoolUtilization", poolUtilization, UnitPercent, d.TimeStamp,
+				dimension, Dimension{Name: "User", Value: pool.User}))
+		}
+	}
+
+	if found {
+		if d.PoolSize > 0 {
+			dest = append(dest, newMetric("PoolUtilization", utilization, UnitPercent, d.TimeStamp, dimension))
+		}
+		dest = append(dest, newMetric("ReservePoolInUse", reserve, UnitCount, d.TimeStamp, dimension))
+	}
+	return dest
+}
+
+func getDatabaseData(ctx context.Context, db *sqlx.DB) (DBDatabases, error) {
+	var databases []Database
+	err := selectContext(ctx, db.Unsafe(), &databases, `SHOW DATABASES`)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(DBDatabases)
+	for _, item := range databases {
+		if item.Name == "pgbouncer" {
+			continue
+		}
+		item.TimeStamp = time.Now()
+		result[item.Name] = item
+	}
+	return result, nil
+}
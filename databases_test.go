@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestGetDatabaseData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{
+		"name", "host", "port", "database", "force_user", "pool_size", "reserve_pool",
+		"pool_mode", "max_connections", "current_connections", "paused", "disabled",
+	}).
+		AddRow("test_1", "localhost", 5432, "test_1", nil, 20, 5, nil, 0, 12, 0, 0).
+		AddRow("pgbouncer", nil, 6432, "pgbouncer", "pgbouncer", 2, 0, "statement", 0, 0, 0, 0)
+	mock.ExpectQuery("SHOW DATABASES").WillReturnRows(rows)
+
+	databases, err := getDatabaseData(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+
+	expected := DBDatabases{
+		"test_1": Database{
+			Name:               "test_1",
+			PoolSize:           20,
+			ReservePool:        5,
+			CurrentConnections: 12,
+			TimeStamp:          databases["test_1"].TimeStamp,
+		},
+	}
+	assert.Equal(t, expected, databases)
+}
+
+func TestDatabaseAddMetricData(t *testing.T) {
+	database := Database{Name: "test_1", PoolSize: 10, Paused: 1}
+	pools := DBPools{
+		poolKey{"test_1", "app"}:     Pool{Database: "test_1", User: "app", ServersActive: 5, ServersIdle: 7},
+		poolKey{"test_1", "migrate"}: Pool{Database: "test_1", User: "migrate", ServersActive: 1},
+		poolKey{"test_2", "app"}:     Pool{Database: "test_2", User: "app", ServersActive: 10},
+		poolKey{}:                    Pool{IsAggregated: true, ServersActive: 16},
+	}
+
+	values := make(map[string]float64)
+	for _, metric := range database.addMetricData(nil, pools) {
+		key := metric.Name
+		for _, dimension := range metric.Dimensions[1:] {
+			key += "/" + dimension.Value
+		}
+		values[key] = metric.Value
+	}
+
+	assert.Equal(t, map[string]float64{
+		"Paused":                  1,
+		"Disabled":                0,
+		"PoolUtilization/app":     50,
+		"PoolUtilization/migrate": 10,
+		"PoolUtilization":         50,
+		"ReservePoolInUse":        2,
+	}, values)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// emfMaxMetrics is the maximum number of metrics in a single EMF
+// directive.
+const emfMaxMetrics = 100
+
+// emfSink writes the metrics as CloudWatch Embedded Metric Format lines,
+// which CloudWatch Logs turns into metrics without PutMetricData calls.
+type emfSink struct {
+	mu        sync.Mutex
+	w         io.Writer
+	namespace string
+}
+
+type emfMetric struct {
+	Name              string `json:"Name"`
+	Unit              Unit   `json:"Unit"`
+	StorageResolution int    `json:"StorageResolution,omitempty"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// emfRecord holds the metrics sharing their dimensions and timestamp, which
+// are written as a single line.
+type emfRecord struct {
+	dimensions []Dimension
+	timestamp  int64
+	metrics    []Metric
+}
+
+func newEMFSink(cfg sinkConfig) (Sink, error) {
+	if cfg.emfOutput == "" || cfg.emfOutput == "-" {
+		return &emfSink{w: os.Stdout, namespace: cfg.namespace}, nil
+	}
+	file, err := os.OpenFile(cfg.emfOutput, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &emfSink{w: file, namespace: cfg.namespace}, nil
+}
+
+func (e *emfSink) Name() string {
+	return "emf"
+}
+
+func (e *emfSink) Push(metrics []Metric) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	encoder := json.NewEncoder(e.w)
+	var lastErr error
+	for _, record := range groupEMFRecords(metrics) {
+		for i := 0; i < len(record.metrics); i += emfMaxMetrics {
+			line := record.line(e.namespace, record.metrics[i:min(i+emfMaxMetrics, len(record.metrics))])
+			if err := encoder.Encode(line); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+// groupEMFRecords groups the metrics by their dimensions and timestamp, in
+// the order they first appear.
+func groupEMFRecords(metrics []Metric) []*emfRecord {
+	var records []*emfRecord
+	index := make(map[string]*emfRecord)
+	for _, metric := range metrics {
+		timestamp := metric.TimeStamp.UnixNano() / 1e6
+		parts := []string{strconv.FormatInt(timestamp, 10)}
+		for _, dimension := range metric.Dimensions {
+			parts = append(parts, dimension.Name+"="+dimension.Value)
+		}
+		key := strings.Join(parts, "\x00")
+
+		record, ok := index[key]
+		if !ok {
+			record = &emfRecord{dimensions: metric.Dimensions, timestamp: timestamp}
+			index[key] = record
+			records = append(records, record)
+		}
+		record.metrics = append(record.metrics, metric)
+	}
+	return records
+}
+
+func (r *emfRecord) line(namespace string, metrics []Metric) map[string]interface{} {
+	names := make([]string, len(r.dimensions))
+	for i, dimension := range r.dimensions {
+		names[i] = dimension.Name
+	}
+
+	directive := emfDirective{
+		Namespace:  namespace,
+		Dimensions: [][]string{names},
+	}
+	line := make(map[string]interface{}, len(r.dimensions)+len(metrics)+1)
+	for _, dimension := range r.dimensions {
+		line[dimension.Name] = dimension.Value
+	}
+	for _, metric := range metrics {
+		m := emfMetric{Name: metric.Name, Unit: metric.Unit}
+		if metric.HighResolution {
+			m.StorageResolution = 1
+		}
+		directive.Metrics = append(directive.Metrics, m)
+		line[metric.Name] = metric.Value
+	}
+	line["_aws"] = emfMetadata{
+		Timestamp:         r.timestamp,
+		CloudWatchMetrics: []emfDirective{directive},
+	}
+	return line
+}
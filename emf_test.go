@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEMFSinkPush(t *testing.T) {
+	var output bytes.Buffer
+	sink := &emfSink{w: &output, namespace: "PGBouncer"}
+
+	timestamp := time.Unix(1500000000, 0)
+	database := Dimension{Name: "Database", Value: "test_1"}
+	metrics := []Metric{
+		newMetric("QueryCount", 12.5, UnitCountSecond, timestamp, database),
+		newMetric("UsedClients", 3, UnitCount, timestamp, Dimension{Name: "InstanceId", Value: "i-1"}),
+		newMetric("QueryTime", 2, UnitMilliseconds, timestamp, database),
+	}
+	metrics[2].HighResolution = true
+
+	assert.Nil(t, sink.Push(metrics))
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1500000000000,
+			"CloudWatchMetrics": [{
+				"Namespace": "PGBouncer",
+				"Dimensions": [["Database"]],
+				"Metrics": [
+					{"Name": "QueryCount", "Unit": "Count/Second"},
+					{"Name": "QueryTime", "Unit": "Milliseconds", "StorageResolution": 1}
+				]
+			}]
+		},
+		"Database": "test_1",
+		"QueryCount": 12.5,
+		"QueryTime": 2
+	}`, lines[0])
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1500000000000,
+			"CloudWatchMetrics": [{
+				"Namespace": "PGBouncer",
+				"Dimensions": [["InstanceId"]],
+				"Metrics": [{"Name": "UsedClients", "Unit": "Count"}]
+			}]
+		},
+		"InstanceId": "i-1",
+		"UsedClients": 3
+	}`, lines[1])
+}
+
+func TestEMFSinkMaxMetrics(t *testing.T) {
+	var output bytes.Buffer
+	sink := &emfSink{w: &output, namespace: "PGBouncer"}
+
+	var metrics []Metric
+	for i := 0; i < emfMaxMetrics+1; i++ {
+		metrics = append(metrics, newMetric("Extra"+string(rune('A'+i%26))+string(rune('A'+i/26)), 1, UnitCount, time.Now()))
+	}
+	assert.Nil(t, sink.Push(metrics))
+	assert.Equal(t, 2, strings.Count(output.String(), "\n"))
+}
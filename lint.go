@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/namsral/flag"
+)
+
+// minSessionPoolSize is the smallest pool_size considered reasonable for a
+// session mode pool, where every client holds a server connection for as
+// long as it is connected.
+const minSessionPoolSize = 5
+
+// User holds the settings of a user as reported by SHOW USERS.
+type User struct {
+	Name     string         `db:"name"`
+	PoolMode sql.NullString `db:"pool_mode"`
+}
+
+// lintProblem is a dangerous combination of settings found by lint.
+type lintProblem struct {
+	Check    string `json:"check"`
+	Database string `json:"database,omitempty"`
+	User     string `json:"user,omitempty"`
+	Message  string `json:"message"`
+}
+
+func getUserData(ctx context.Context, db *sqlx.DB) ([]User, error) {
+	var users []User
+	// Newer pgbouncer versions return the per user limits as well.
+	err := selectContext(ctx, db.Unsafe(), &users, `SHOW USERS`)
+	return users, err
+}
+
+// poolCount returns the number of pools the database may get, pool_size
+// applies to each of them. It is derived from the settings only, a database
+// with force_user has a single pool and any other one a pool for every user
+// which may connect.
+func poolCount(database Database, users []User) float64 {
+	if database.ForceUser.Valid && database.ForceUser.String != "" {
+		return 1
+	}
+	return math.Max(1, float64(len(users)))
+}
+
+// lint checks the settings for dangerous combinations. fdLimit is the soft
+// limit of open files of the pgbouncer process, 0 when unknown.
+func lint(config PGBouncerConfig, databases DBDatabases, users []User, fdLimit float64) []lintProblem {
+	var problems []lintProblem
+	globalMode := config["pool_mode"]
+
+	names := make([]string, 0, len(databases))
+	for name := range databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sessionMode := globalMode == "session"
+	var serverConnections float64
+	for _, name := range names {
+		d := databases[name]
+		count := poolCount(d, users)
+		connections := count * (d.PoolSize + d.ReservePool)
+		serverConnections += connections
+
+		if d.MaxConnections > 0 && connections > d.MaxConnections {
+			problems = append(problems, lintProblem{
+				Check:    "pool_size_above_max_db_connections",
+				Database: name,
+				Message: fmt.Sprintf("%v pools of pool_size %v and reserve_pool %v exceed max_db_connections %v, clients will wait for connections the pools may never get",
+					count, d.PoolSize, d.ReservePool, d.MaxConnections),
+			})
+		}
+
+		mode := globalMode
+		if d.PoolMode.Valid && d.PoolMode.String != "" {
+			mode = d.PoolMode.String
+		}
+		if mode == "session" {
+			sessionMode = true
+			if d.PoolSize < minSessionPoolSize {
+				problems = append(problems, smallSessionPool(name, "", d.PoolSize))
+			}
+		}
+	}
+
+	for _, user := range users {
+		if user.PoolMode.String != "session" {
+			continue
+		}
+		sessionMode = true
+		for _, name := range names {
+			if databases[name].PoolSize < minSessionPoolSize {
+				problems = append(problems, smallSessionPool(name, user.Name, databases[name].PoolSize))
+			}
+		}
+	}
+
+	if sessionMode && config["server_reset_query"] == "" {
+		problems = append(problems, lintProblem{
+			Check:   "missing_server_reset_query",
+			Message: "session mode is used without a server_reset_query, session state leaks between clients",
+		})
+	}
+
+	maxClientConn, ok := config.float("max_client_conn")
+	if ok && fdLimit > 0 && maxClientConn+serverConnections > fdLimit {
+		problems = append(problems, lintProblem{
+			Check: "max_client_conn_above_fd_limit",
+			Message: fmt.Sprintf("max_client_conn %v and %v server connections exceed the open files limit %v",
+				maxClientConn, serverConnections, fdLimit),
+		})
+	}
+	return problems
+}
+
+func smallSessionPool(database string, user string, poolSize float64) lintProblem {
+	return lintProblem{
+		Check:    "small_session_pool",
+		Database: database,
+		User:     user,
+		Message:  fmt.Sprintf("pool_size %v is below %d in session mode, every client holds a server connection", poolSize, minSessionPoolSize),
+	}
+}
+
+func writeLintText(w io.Writer, problems []lintProblem) {
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "No problems found")
+		return
+	}
+	for _, p := range problems {
+		location := ""
+		if p.Database != "" {
+			location = " database=" + p.Database
+		}
+		if p.User != "" {
+			location += " user=" + p.User
+		}
+		fmt.Fprintf(w, "%s%s: %s\n", p.Check, location, p.Message)
+	}
+}
+
+func writeLintJSON(w io.Writer, problems []lintProblem) error {
+	if problems == nil {
+		problems = []lintProblem{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Problems []lintProblem `json:"problems"`
+	}{problems})
+}
+
+// getLintSettings reads the settings checked by lint. The live pools are
+// left out on purpose, the verdict must not depend on the traffic.
+func getLintSettings(ctx context.Context, db *sqlx.DB) (PGBouncerConfig, DBDatabases, []User, error) {
+	config, err := getConfigData(ctx, db)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Unable to read SHOW CONFIG: %v", err)
+	}
+	databases, err := getDatabaseData(ctx, db)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Unable to read SHOW DATABASES: %v", err)
+	}
+	users, err := getUserData(ctx, db)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Unable to read SHOW USERS: %v", err)
+	}
+	return config, databases, users, nil
+}
+
+// runLint implements the lint subcommand. It returns 1 when problems were
+// found and 2 when the settings could not be read.
+func runLint(args []string) int {
+	fs := flag.NewFlagSetWithEnvPrefix("lint", "PGCW", flag.ContinueOnError)
+	databaseURL := fs.String("url", "postgresql://pgbouncer@:6432/pgbouncer?host=/tmp&sslmode=disable", "The URL to the PGBouncerinstance.")
+	asJSON := fs.Bool("json", false, "If the problems should be written as JSON")
+	fdLimit := fs.Int("fd-limit", 0, "The open files limit of pgbouncer, defaults to the limit of the local pgbouncer process")
+	pidfile := fs.String("pidfile", "", "The pidfile of pgbouncer, defaults to the pidfile setting or the only process named pgbouncer")
+	queryTimeout := fs.Int("query-timeout", 5, "Timeout in seconds for each query to PGBouncer.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	metadata.queryTimeout = time.Duration(*queryTimeout) * time.Second
+	metadata.pidfile = *pidfile
+
+	ctx := context.Background()
+	db, err := newDB(ctx, *databaseURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect: %v\n", err)
+		return 2
+	}
+	defer db.Close()
+
+	config, databases, users, err := getLintSettings(ctx, db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	// The process is only visible when running next to pgbouncer.
+	limit := float64(*fdLimit)
+	if limit == 0 {
+		if process, err := getProcessData(config); err == nil {
+			limit = process.MaxOpenFiles
+		} else {
+			fmt.Fprintf(os.Stderr, "Skipping the open files check, use --fd-limit: %v\n", err)
+		}
+	}
+
+	problems := lint(config, databases, users, limit)
+	if *asJSON {
+		if err := writeLintJSON(os.Stdout, problems); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	} else {
+		writeLintText(os.Stdout, problems)
+	}
+
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
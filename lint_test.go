@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestGetUserData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"name", "pool_mode"}).
+		AddRow("app", nil).
+		AddRow("reporting", "session")
+	mock.ExpectQuery("SHOW USERS").WillReturnRows(rows)
+
+	users, err := getUserData(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.Equal(t, []User{
+		{Name: "app"},
+		{Name: "reporting", PoolMode: sql.NullString{String: "session", Valid: true}},
+	}, users)
+}
+
+func TestLint(t *testing.T) {
+	config := PGBouncerConfig{"pool_mode": "transaction", "max_client_conn": "1000", "server_reset_query": ""}
+	databases := DBDatabases{
+		"test_1": {Name: "test_1", PoolSize: 20, ReservePool: 5, MaxConnections: 20},
+		"test_2": {Name: "test_2", PoolSize: 2, PoolMode: sql.NullString{String: "session", Valid: true}},
+	}
+
+	problems := lint(config, databases, nil, 1024)
+	checks := make([]string, 0, len(problems))
+	for _, p := range problems {
+		checks = append(checks, p.Check)
+	}
+	assert.Equal(t, []string{
+		"pool_size_above_max_db_connections",
+		"small_session_pool",
+		"missing_server_reset_query",
+		"max_client_conn_above_fd_limit",
+	}, checks)
+	assert.Equal(t, "test_2", problems[1].Database)
+
+	// Without a fd limit the check is skipped
+	assert.Len(t, lint(config, databases, nil, 0), 3)
+
+	healthy := DBDatabases{"test_1": {Name: "test_1", PoolSize: 20}}
+	assert.Empty(t, lint(config, healthy, nil, 4096))
+
+	users := []User{{Name: "reporting", PoolMode: sql.NullString{String: "session", Valid: true}}}
+	config["server_reset_query"] = "DISCARD ALL"
+	assert.Empty(t, lint(config, healthy, users, 4096))
+
+	small := DBDatabases{"test_1": {Name: "test_1", PoolSize: 2}}
+	assert.Equal(t, []lintProblem{{
+		Check:    "small_session_pool",
+		Database: "test_1",
+		User:     "reporting",
+		Message:  "pool_size 2 is below 5 in session mode, every client holds a server connection",
+	}}, lint(config, small, users, 4096))
+}
+
+func TestWriteLint(t *testing.T) {
+	problems := []lintProblem{{Check: "small_session_pool", Database: "test_1", Message: "too small"}}
+
+	var text bytes.Buffer
+	writeLintText(&text, problems)
+	assert.Equal(t, "small_session_pool database=test_1: too small\n", text.String())
+
+	text.Reset()
+	writeLintText(&text, nil)
+	assert.Equal(t, "No problems found\n", text.String())
+
+	var output bytes.Buffer
+	assert.Nil(t, writeLintJSON(&output, nil))
+	assert.JSONEq(t, `{"problems": []}`, output.String())
+
+	output.Reset()
+	assert.Nil(t, writeLintJSON(&output, problems))
+	assert.JSONEq(t, `{"problems": [{"check": "small_session_pool", "database": "test_1", "message": "too small"}]}`, output.String())
+}
+
+func TestLintSharedDatabase(t *testing.T) {
+	config := PGBouncerConfig{"pool_mode": "transaction", "max_client_conn": "1000"}
+	databases := DBDatabases{"test_1": {Name: "test_1", PoolSize: 20, MaxConnections: 30}}
+	users := []User{{Name: "app"}, {Name: "migrate"}}
+
+	problems := lint(config, databases, users, 0)
+	assert.Equal(t, []lintProblem{{
+		Check:    "pool_size_above_max_db_connections",
+		Database: "test_1",
+		Message:  "2 pools of pool_size 20 and reserve_pool 0 exceed max_db_connections 30, clients will wait for connections the pools may never get",
+	}}, problems)
+
+	// A database with force_user only ever has a single pool
+	databases["test_1"] = Database{Name: "test_1", PoolSize: 20, MaxConnections: 30,
+		ForceUser: sql.NullString{String: "app", Valid: true}}
+	assert.Empty(t, lint(config, databases, users, 0))
+	assert.Empty(t, lint(config, databases, users, 1020))
+
+	// The server connections of all pools count against the fd limit
+	problems = lint(config, DBDatabases{"test_1": {Name: "test_1", PoolSize: 20}}, users, 1030)
+	assert.Equal(t, "max_client_conn_above_fd_limit", problems[0].Check)
+}
+
+func TestGetLintSettings(t *testing.T) {
+	verdict := func(pools bool) []lintProblem {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SHOW CONFIG").WillReturnRows(sqlmock.NewRows([]string{"key", "value", "changeable"}).
+			AddRow("pool_mode", "transaction", "yes").
+			AddRow("max_client_conn", "1000", "yes"))
+		mock.ExpectQuery("SHOW DATABASES").WillReturnRows(sqlmock.NewRows([]string{"name", "force_user", "pool_size", "reserve_pool", "max_connections"}).
+			AddRow("test_1", nil, 20, 0, 30))
+		mock.ExpectQuery("SHOW USERS").WillReturnRows(sqlmock.NewRows([]string{"name", "pool_mode"}).
+			AddRow("app", nil).
+			AddRow("migrate", nil))
+		if pools {
+			mock.ExpectQuery("SHOW POOLS").WillReturnRows(sqlmock.NewRows([]string{"database", "user"}).
+				AddRow("test_1", "app"))
+		}
+
+		config, databases, users, err := getLintSettings(context.Background(), sqlx.NewDb(db, "sqlmock"))
+		assert.Nil(t, err)
+		return lint(config, databases, users, 0)
+	}
+
+	// Live pools are never read, the same settings give the same verdict
+	// whether clients are connected or not.
+	withPools := verdict(true)
+	assert.Len(t, withPools, 1)
+	assert.Equal(t, verdict(false), withPools)
+}
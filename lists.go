@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type listEntry struct {
+	List  string  `db:"list"`
+	Items float64 `db:"items"`
+}
+
+type Lists struct {
+	Databases     float64
+	Users         float64
+	Pools         float64
+	FreeClients   float64
+	UsedClients   float64
+	LoginClients  float64
+	FreeServers   float64
+	UsedServers   float64
+	MaxClientConn float64
+	TimeStamp     time.Time
+}
+
+// clientConnectionUtilization returns the percentage of max_client_conn
+// which is in use.
+func (l *Lists) clientConnectionUtilization() float64 {
+	if l.MaxClientConn <= 0 {
+		return 0
+	}
+	return l.UsedClients * 100 / l.MaxClientConn
+}
+
+// aggregate adds the lists of another pgbouncer instance, all the counts
+// are summed.
+func (l *Lists) aggregate(o Lists) {
+	l.Databases += o.Databases
+	l.Users += o.Users
+	l.Pools += o.Pools
+	l.FreeClients += o.FreeClients
+	l.UsedClients += o.UsedClients
+	l.LoginClients += o.LoginClients
+	l.FreeServers += o.FreeServers
+	l.UsedServers += o.UsedServers
+	l.MaxClientConn += o.MaxClientConn
+}
+
+func (l *Lists) addMetricData(dest []Metric) []Metric {
+	items := map[string]metricValue{
+		"UsedClients":                 {l.UsedClients, UnitCount},
+		"FreeClients":                 {l.FreeClients, UnitCount},
+		"LoginClients":                {l.LoginClients, UnitCount},
+		"UsedServers":                 {l.UsedServers, UnitCount},
+		"FreeServers":                 {l.FreeServers, UnitCount},
+		"Pools":                       {l.Pools, UnitCount},
+		"ClientConnectionUtilization": {l.clientConnectionUtilization(), UnitPercent},
+	}
+
+	metricItems := []string{"UsedClients", "FreeClients", "LoginClients", "UsedServers", "FreeServers", "Pools"}
+	if l.MaxClientConn > 0 {
+		metricItems = append(metricItems, "ClientConnectionUtilization")
+	}
+
+	dimensions := []Dimension{
+		{Name: "Across all instances", Value: "instances"},
+		{Name: "InstanceId", Value: metadata.InstanceID},
+	}
+	for _, dimension := range dimensions {
+		for _, key := range metricItems {
+			dest = append(dest, newMetric(key, items[key].value, items[key].unit, l.TimeStamp, dimension))
+		}
+	}
+	return dest
+}
+
+func getListsData(ctx context.Context, db *sqlx.DB, config PGBouncerConfig) (*Lists, error) {
+	var entries []listEntry
+	err := selectContext(ctx, db, &entries, `SHOW LISTS`)
+	if err != nil {
+		return nil, err
+	}
+
+	lists := Lists{TimeStamp: time.Now()}
+	for _, entry := range entries {
+		switch entry.List {
+		case "databases":
+			lists.Databases = entry.Items
+		case "users":
+			lists.Users = entry.Items
+		case "pools":
+			lists.Pools = entry.Items
+		case "free_clients":
+			lists.FreeClients = entry.Items
+		case "used_clients":
+			lists.UsedClients = entry.Items
+		case "login_clients":
+			lists.LoginClients = entry.Items
+		case "free_servers":
+			lists.FreeServers = entry.Items
+		case "used_servers":
+			lists.UsedServers = entry.Items
+		}
+	}
+
+	lists.MaxClientConn, _ = config.float("max_client_conn")
+	return &lists, nil
+}
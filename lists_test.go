@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestGetListsData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	lists := sqlmock.NewRows([]string{"list", "items"}).
+		AddRow("databases", 2).
+		AddRow("users", 3).
+		AddRow("pools", 4).
+		AddRow("free_clients", 45).
+		AddRow("used_clients", 55).
+		AddRow("login_clients", 1).
+		AddRow("free_servers", 10).
+		AddRow("used_servers", 20).
+		AddRow("dns_names", 0)
+	mock.ExpectQuery("SHOW LISTS").WillReturnRows(lists)
+
+	config := PGBouncerConfig{"listen_port": "6432", "max_client_conn": "200"}
+
+	result, err := getListsData(context.Background(), sqlx.NewDb(db, "sqlmock"), config)
+	assert.Nil(t, err)
+
+	expected := &Lists{
+		Databases:     2,
+		Users:         3,
+		Pools:         4,
+		FreeClients:   45,
+		UsedClients:   55,
+		LoginClients:  1,
+		FreeServers:   10,
+		UsedServers:   20,
+		MaxClientConn: 200,
+		TimeStamp:     result.TimeStamp,
+	}
+	assert.Equal(t, expected, result)
+	assert.Equal(t, 27.5, result.clientConnectionUtilization())
+}
+
+func TestListsAddMetricDataWithoutMaxClientConn(t *testing.T) {
+	lists := Lists{UsedClients: 10}
+
+	metrics := lists.addMetricData(nil)
+	assert.Equal(t, 12, len(metrics))
+	for _, metric := range metrics {
+		assert.NotEqual(t, "ClientConnectionUtilization", metric.Name)
+	}
+}
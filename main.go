@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"time"
@@ -11,32 +12,57 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 )
 
 type instanceMetadata struct {
-	InstanceID         string
-	Region             string
-	detailedMonitoring bool
+	InstanceID            string
+	Region                string
+	detailedMonitoring    bool
+	collectPools          bool
+	poolMetrics           []string
+	highResolutionMetrics []string
+	fingerprintExclude    []string
+	collectClients        bool
+	clientsMaxGroups      int
+	collectServers        bool
+	pgbouncerLocation     *time.Location
+	collectInternals      bool
+	collectFds            bool
+	collectProcess        bool
+	pidfile               string
+	sampleInterval        time.Duration
+	burst                 burstConfig
+	queryTimeout          time.Duration
+	scrapeTimeout         time.Duration
 }
 
 var metadata instanceMetadata
 
-func newDB(url string) (*sqlx.DB, error) {
-	db, err := sqlx.Connect("postgres", url)
+func newDB(ctx context.Context, url string) (*sqlx.DB, error) {
+	db, err := sqlx.ConnectContext(ctx, "postgres", url)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = db.Ping(); err != nil {
-		return nil, err
-	}
-
+	// The admin console is stateful, so make sure every query uses the same
+	// long-lived connection.
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
 	return db, nil
 }
 
+// selectContext runs the query with the configured per query timeout.
+func selectContext(ctx context.Context, db sqlx.QueryerContext, dest interface{}, query string) error {
+	if metadata.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, metadata.queryTimeout)
+		defer cancel()
+	}
+	return sqlx.SelectContext(ctx, db, dest, query)
+}
+
 func getInstanceMetadata(cfg aws.Config) {
 	log.Println("Retrieving instance metadata")
 	svc := ec2metadata.New(cfg)
@@ -52,16 +78,65 @@ func getInstanceMetadata(cfg aws.Config) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		os.Exit(runLint(os.Args[2:]))
+	}
+
 	// Parse the command line arguments
 	fs := flag.NewFlagSetWithEnvPrefix(os.Args[0], "PGCW", 0)
 	instanceID := fs.String("instance-id", "", "Override default instance id.")
 	region := fs.String("region", "", "Override default AWS region.")
 	databaseURL := fs.String("url", "postgresql://pgbouncer@:6432/pgbouncer?host=/tmp&sslmode=disable", "The URL to the PGBouncerinstance.")
-	interval := fs.Int("interval", 60, "Interval between each run.")
+	var targets targetList
+	fs.Var(&targets, "target", "A PGBouncer instance as <name>=<url>[;<dimension>=<value>...], can be repeated (overrides --url)")
+	interval := fs.Int("interval", 60, "Interval in seconds between each run, use intervals below 60 with --high-resolution.")
+	sampleInterval := fs.Int("sample-interval", 0, "Interval in seconds to sample the pools between scrapes, published as statistic sets (requires --detailed, default disabled)")
+	burstInterval := fs.Int("burst-interval", 0, "Interval in seconds used while pools are under pressure, published with a high resolution (the waiting clients triggers require --detailed, default disabled)")
+	burstDuration := fs.Int("burst-duration", 300, "Duration in seconds of the burst interval after the last trigger")
+	burstMaxWait := fs.Float64("burst-max-wait", 1, "Start a burst when clients wait or a client waits longer than this number of seconds (requires --detailed)")
+	burstQueryTimeJump := fs.Float64("burst-query-time-jump", 2, "Start a burst when the average query time grows by this factor between intervals, 0 to disable")
+	queryTimeout := fs.Int("query-timeout", 5, "Timeout in seconds for each query to PGBouncer.")
+	scrapeTimeout := fs.Int("scrape-timeout", 15, "Timeout in seconds for collecting the data of all targets.")
 	namespace := fs.String("namespace", "PGBouncer", "The CloudWatch namespace")
 	detailed := fs.Bool("detailed", false, "If detailed metrics should be enabled")
+	clients := fs.Bool("clients", false, "If the client connections should be collected, grouped by application name, user and subnet")
+	clientsMaxGroups := fs.Int("clients-max-groups", 50, "The maximum number of client groups to publish, the remaining clients are published as 'other'")
+	servers := fs.Bool("servers", false, "If the server connections should be collected per database and user")
+	timezone := fs.String("pgbouncer-timezone", "Local", "The time zone of the pgbouncer hosts (e.g. Europe/Amsterdam), used to read the connect times of the server connections")
+	internals := fs.Bool("internals", false, "If the internal memory caches should be collected")
+	fds := fs.Bool("internals-fds", false, "If the file descriptors per task should be collected with SHOW FDS (requires --internals). Warning: SHOW FDS is meant for online restarts, it blocks the admin console while sending and returns the cancel keys and password hashes of every connection, prefer --process for the number of open files. Over a unix socket pgbouncer passes the file descriptors themselves, which would leak on every scrape, so it requires TCP targets")
+	process := fs.Bool("process", false, "If the CPU, memory, open files and threads of the pgbouncer process should be collected from /proc")
+	pidfile := fs.String("pidfile", "", "The pidfile of pgbouncer, defaults to the pidfile setting or the only process named pgbouncer")
+	prometheusListen := fs.String("prometheus-listen", ":9813", "The address to serve Prometheus metrics on when the prometheus sink is enabled")
+	emfOutput := fs.String("emf-output", "-", "The file to write Embedded Metric Format lines to when the emf sink is enabled, - for stdout")
+	statsdAddress := fs.String("statsd-address", "127.0.0.1:8125", "The UDP address or unix:///<path> datagram socket of the StatsD agent when the statsd sink is enabled")
+	statsdPrefix := fs.String("statsd-prefix", "pgbouncer.", "The prefix of the StatsD metric names")
+	statsdTags := fs.Bool("statsd-tags", true, "If the dimensions should be sent as DogStatsD tags instead of in the metric name")
+	otlpEndpoint := fs.String("otlp-endpoint", "http://localhost:4318/v1/metrics", "The OTLP metrics endpoint of the OpenTelemetry collector when the otlp sink is enabled, for grpc the https:// address of the collector (plaintext gRPC is not supported)")
+	otlpProtocol := fs.String("otlp-protocol", "http/protobuf", "The OTLP protocol, http/protobuf or grpc")
+	var poolMetrics stringList
+	fs.Var(&poolMetrics, "pool-metrics", "The pool metrics to publish, can be repeated (default all)")
+	var highResolution stringList
+	fs.Var(&highResolution, "high-resolution", "The metrics to publish with a one second storage resolution, 'all' for every metric, can be repeated. The extra columns of newer pgbouncer versions are selected by their metric name, e.g. ClientWaitTime for total_client_wait_time")
+	var fingerprintExclude stringList
+	fs.Var(&fingerprintExclude, "fingerprint-exclude", "Settings left out of the ConfigFingerprint in addition to the instance local ones (listen_port, pidfile, ...), can be repeated")
+	var sinkNames stringList
+	fs.Var(&sinkNames, "sink", "The sink to push metrics to, can be repeated (default cloudwatch)")
 	fs.Parse(os.Args[1:])
 
+	if len(targets) == 0 {
+		targets = targetList{{URL: *databaseURL}}
+	}
+
+	if len(sinkNames) == 0 {
+		sinkNames = stringList{"cloudwatch"}
+	}
+	if stringInSlice("otlp", sinkNames) {
+		if err := checkOTLPProtocol(*otlpProtocol, *otlpEndpoint); err != nil {
+			log.Fatalf("Invalid OTLP flags: %v", err)
+		}
+	}
+
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
 		panic("unable to load SDK config, " + err.Error())
@@ -72,6 +147,63 @@ func main() {
 	}
 
 	metadata.detailedMonitoring = *detailed
+	metadata.collectClients = *clients
+	metadata.clientsMaxGroups = *clientsMaxGroups
+	metadata.collectServers = *servers
+	metadata.pgbouncerLocation, err = time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("Invalid --pgbouncer-timezone: %v", err)
+	}
+	metadata.collectInternals = *internals
+	metadata.collectFds = *internals && *fds
+	if *fds && !*internals {
+		log.Println("Collecting SHOW FDS requires --internals, disabling it")
+	}
+	// pgbouncer passes the file descriptors themselves over a unix socket,
+	// lib/pq never closes them so every scrape would leak them.
+	for _, t := range targets {
+		if metadata.collectFds && t.unixSocket() {
+			log.Fatalf("--internals-fds can't be used with the unix socket target %q, connect over TCP or use --process for the number of open files", t.URL)
+		}
+	}
+	metadata.collectProcess = *process
+	metadata.pidfile = *pidfile
+	metadata.queryTimeout = time.Duration(*queryTimeout) * time.Second
+	if *sampleInterval > 0 && *detailed {
+		metadata.sampleInterval = time.Duration(*sampleInterval) * time.Second
+	} else if *sampleInterval > 0 {
+		log.Println("Sampling the pools requires --detailed, disabling it")
+	}
+	metadata.scrapeTimeout = time.Duration(*scrapeTimeout) * time.Second
+	for _, name := range poolMetrics {
+		if !stringInSlice(name, poolMetricNames) {
+			log.Fatalf("Unknown pool metric %q, expected one of %v", name, poolMetricNames)
+		}
+	}
+	if len(poolMetrics) > 0 {
+		metadata.poolMetrics = poolMetrics
+	}
+	for _, name := range highResolution {
+		if name == "all" || stringInSlice(name, metricNames) {
+			continue
+		}
+		// The extra columns are only known once pgbouncer is queried
+		if !isColumnMetricName(name) {
+			log.Fatalf("Unknown metric %q for --high-resolution, expected all, one of %v or the metric of an extra column", name, metricNames)
+		}
+		log.Printf("Metric %q for --high-resolution is not a built-in metric, assuming it's an extra column of a newer pgbouncer version\n", name)
+	}
+	metadata.highResolutionMetrics = highResolution
+	metadata.fingerprintExclude = fingerprintExclude
+	metadata.burst = burstConfig{
+		interval:      time.Duration(*burstInterval) * time.Second,
+		duration:      time.Duration(*burstDuration) * time.Second,
+		maxWait:       *burstMaxWait,
+		queryTimeJump: *burstQueryTimeJump,
+	}
+	if *interval < 1 {
+		log.Fatalf("The interval must be at least 1 second, got %d", *interval)
+	}
 	if *instanceID != "" {
 		metadata.InstanceID = *instanceID
 	} else {
@@ -83,11 +215,36 @@ func main() {
 	}
 
 	cfg.Region = metadata.Region
-	cwService := cloudwatch.New(cfg)
-	stats := statusLog{}
+	sinks, err := newSinks(sinkNames, sinkConfig{
+		aws:              cfg,
+		namespace:        *namespace,
+		prometheusListen: *prometheusListen,
+		emfOutput:        *emfOutput,
+		statsdAddress:    *statsdAddress,
+		statsdPrefix:     *statsdPrefix,
+		statsdTags:       *statsdTags,
+		otlpEndpoint:     *otlpEndpoint,
+		otlpProtocol:     *otlpProtocol,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, sink := range sinks {
+		if _, ok := sink.(snapshotSink); ok {
+			metadata.collectPools = true
+		}
+	}
+	if metadata.burst.interval > 0 && !metadata.detailedMonitoring && !metadata.collectPools {
+		log.Println("The waiting clients burst triggers require --detailed, only query time jumps start a burst")
+	}
+
 	log.Println("Running")
+	period := time.Duration(*interval) * time.Second
+	next := time.Now()
 	for {
-		collectStats(*databaseURL, *namespace, &stats, cwService)
-		time.Sleep(time.Duration(*interval) * time.Second)
+		collectStats(targets, sinks)
+		now := time.Now()
+		next = nextRun(next, burst.interval(period, now), now)
+		sampleUntil(targets, next)
 	}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MemCache is a single internal memory cache as reported by SHOW MEM.
+type MemCache struct {
+	Name     string  `db:"name"`
+	Size     float64 `db:"size"`
+	Used     float64 `db:"used"`
+	Free     float64 `db:"free"`
+	MemTotal float64 `db:"memtotal"`
+}
+
+type fileDescriptor struct {
+	Fd   float64 `db:"fd"`
+	Task string  `db:"task"`
+}
+
+// Internals holds the internal resource usage of pgbouncer.
+type Internals struct {
+	Caches []MemCache
+	// FileDescriptors holds the number of file descriptors per task
+	// (pooler, client or server), nil unless SHOW FDS is enabled.
+	FileDescriptors map[string]float64
+	TimeStamp       time.Time
+}
+
+func (i *Internals) addMetricData(dest []Metric) []Metric {
+	instance := Dimension{Name: "InstanceId", Value: metadata.InstanceID}
+	for _, cache := range i.Caches {
+		dimension := Dimension{Name: "Cache", Value: cache.Name}
+		dest = append(dest,
+			newMetric("MemoryCacheUsed", cache.Used, UnitCount, i.TimeStamp, instance, dimension),
+			newMetric("MemoryCacheFree", cache.Free, UnitCount, i.TimeStamp, instance, dimension),
+			newMetric("MemoryCacheTotal", cache.MemTotal, UnitBytes, i.TimeStamp, instance, dimension),
+			newMetric("MemoryCacheItemSize", cache.Size, UnitBytes, i.TimeStamp, instance, dimension))
+	}
+
+	if i.FileDescriptors == nil {
+		return dest
+	}
+	var total float64
+	for _, task := range sortedExtraKeys(i.FileDescriptors) {
+		count := i.FileDescriptors[task]
+		total += count
+		dest = append(dest, newMetric(
+			"FileDescriptors", count, UnitCount, i.TimeStamp,
+			instance, Dimension{Name: "Task", Value: task}))
+	}
+	dest = append(dest, newMetric("FileDescriptors", total, UnitCount, i.TimeStamp, instance))
+	return dest
+}
+
+func getInternalsData(ctx context.Context, db *sqlx.DB) (*Internals, error) {
+	result := Internals{TimeStamp: time.Now()}
+
+	err := selectContext(ctx, db, &result.Caches, `SHOW MEM`)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result.Caches, func(i, j int) bool {
+		return result.Caches[i].Name < result.Caches[j].Name
+	})
+
+	// SHOW FDS is meant for online restarts, it blocks the admin console
+	// while sending and includes the cancel keys of every connection.
+	if !metadata.collectFds {
+		return &result, nil
+	}
+	var fds []fileDescriptor
+	err = selectContext(ctx, db.Unsafe(), &fds, `SHOW FDS`)
+	if err != nil {
+		return nil, err
+	}
+	result.FileDescriptors = make(map[string]float64)
+	for _, fd := range fds {
+		result.FileDescriptors[fd.Task]++
+	}
+	return &result, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestGetInternalsData(t *testing.T) {
+	defer func(old bool) { metadata.collectFds = old }(metadata.collectFds)
+	metadata.collectFds = true
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mem := sqlmock.NewRows([]string{"name", "size", "used", "free", "memtotal"}).
+		AddRow("user_cache", 184, 4, 85, 16376).
+		AddRow("iobuf_cache", 4112, 2, 48, 205600)
+	mock.ExpectQuery("SHOW MEM").WillReturnRows(mem)
+
+	fds := sqlmock.NewRows([]string{"fd", "task", "user", "database", "addr", "port"}).
+		AddRow(6, "pooler", nil, nil, "127.0.0.1", 6432).
+		AddRow(7, "pooler", nil, nil, "unix", 6432).
+		AddRow(9, "client", "app", "test_1", "127.0.0.1", 50000).
+		AddRow(10, "server", "app", "test_1", "127.0.0.1", 5432)
+	mock.ExpectQuery("SHOW FDS").WillReturnRows(fds)
+
+	internals, err := getInternalsData(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []MemCache{
+		{Name: "iobuf_cache", Size: 4112, Used: 2, Free: 48, MemTotal: 205600},
+		{Name: "user_cache", Size: 184, Used: 4, Free: 85, MemTotal: 16376},
+	}, internals.Caches)
+	assert.Equal(t, map[string]float64{"pooler": 2, "client": 1, "server": 1}, internals.FileDescriptors)
+
+	var total, size float64
+	for _, metric := range internals.addMetricData(nil) {
+		assert.Contains(t, metricNames, metric.Name)
+		if metric.Name == "FileDescriptors" && len(metric.Dimensions) == 1 {
+			total = metric.Value
+		}
+		if metric.Name == "MemoryCacheItemSize" && metric.Dimensions[1].Value == "iobuf_cache" {
+			size = metric.Value
+		}
+	}
+	assert.Equal(t, float64(4), total)
+	assert.Equal(t, float64(4112), size)
+}
+
+func TestGetInternalsDataWithoutFds(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mem := sqlmock.NewRows([]string{"name", "size", "used", "free", "memtotal"}).
+		AddRow("user_cache", 184, 4, 85, 16376)
+	mock.ExpectQuery("SHOW MEM").WillReturnRows(mem)
+
+	internals, err := getInternalsData(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Nil(t, internals.FileDescriptors)
+
+	for _, metric := range internals.addMetricData(nil) {
+		assert.NotEqual(t, "FileDescriptors", metric.Name)
+	}
+}
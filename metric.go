@@ -0,0 +1,119 @@
+package main
+
+import "time"
+
+// Unit describes the unit of a metric value. The values match the
+// CloudWatch standard units so they can be passed through as-is.
+type Unit string
+
+const (
+	UnitCount        Unit = "Count"
+	UnitCountSecond  Unit = "Count/Second"
+	UnitSeconds      Unit = "Seconds"
+	UnitMilliseconds Unit = "Milliseconds"
+	UnitBytes        Unit = "Bytes"
+	UnitBytesSecond  Unit = "Bytes/Second"
+	UnitPercent      Unit = "Percent"
+	UnitNone         Unit = "None"
+)
+
+type Dimension struct {
+	Name  string
+	Value string
+}
+
+// Metric is a single backend-neutral data point, converted by each Sink
+// into whatever representation the backend expects.
+type Metric struct {
+	Name       string
+	Unit       Unit
+	Value      float64
+	TimeStamp  time.Time
+	Dimensions []Dimension
+	// Statistics summarises the samples taken within the interval, Value
+	// holds the last sample for sinks which don't support statistics.
+	Statistics *StatisticSet
+	// HighResolution stores the metric with a one second resolution
+	HighResolution bool
+}
+
+// StatisticSet holds the minimum, maximum, sum and number of samples of a
+// metric.
+type StatisticSet struct {
+	Minimum     float64
+	Maximum     float64
+	Sum         float64
+	SampleCount float64
+}
+
+func (s *StatisticSet) add(value float64) {
+	if s.SampleCount == 0 || value < s.Minimum {
+		s.Minimum = value
+	}
+	if s.SampleCount == 0 || value > s.Maximum {
+		s.Maximum = value
+	}
+	s.Sum += value
+	s.SampleCount++
+}
+
+// metricNames are the names of the metrics, except those of the extra
+// columns added by newer pgbouncer versions.
+var metricNames = []string{
+	// stats
+	"QueryCount", "QueryTime", "WaitTime", "TransactionCount", "TransactionTime",
+	"BytesReceived", "BytesSent", "ServerAssignmentCount", "ClientParseCount",
+	"ServerParseCount", "BindCount", "PreparedStatementHitRatio", "Restarts",
+	// pools and databases
+	"ClientsActive", "ClientsWaiting", "ServersActive", "ServersIdle", "ServersUsed",
+	"ServersTested", "ServersLogin", "MaxWait", "Paused", "Disabled",
+	"PoolUtilization", "ReservePoolInUse",
+	// lists and config
+	"UsedClients", "FreeClients", "LoginClients", "UsedServers", "FreeServers",
+	"Pools", "ClientConnectionUtilization", "ConfigFingerprint", "ConfigChanged",
+	// clients and servers
+	"ClientConnections", "ClientConnectionsWaiting", "ClientOldestWait",
+	"ClientPreparedStatements", "ServerConnections", "ServerConnectionsByAge",
+	"ServerConnectionMaxAge", "ServerPreparedStatements", "ServerConnectionsOpened",
+	"ServerConnectionsClosed",
+	// internals and process
+	"MemoryCacheUsed", "MemoryCacheFree", "MemoryCacheTotal", "MemoryCacheItemSize", "FileDescriptors",
+	"ProcessResidentMemory", "ProcessOpenFiles", "ProcessThreads", "ProcessUptime",
+	"ProcessOpenFilesUtilization", "ProcessCPUUtilization",
+}
+
+// countMetricNames are the metrics counting events within the interval,
+// unlike the other metrics they don't describe a state which persists.
+var countMetricNames = []string{"Restarts", "ConfigChanged", "ServerConnectionsOpened", "ServerConnectionsClosed"}
+
+// metricValue is used by the collectors to map their metric names to the
+// value and unit.
+type metricValue struct {
+	value float64
+	unit  Unit
+}
+
+func newMetric(name string, value float64, unit Unit, timestamp time.Time, dimensions ...Dimension) Metric {
+	return Metric{
+		Name:       name,
+		Unit:       unit,
+		Value:      value,
+		TimeStamp:  timestamp,
+		Dimensions: dimensions,
+	}
+}
+
+// markHighResolution sets HighResolution on the metrics whose name is in
+// names, "all" selects every metric.
+func markHighResolution(metrics []Metric, names []string) []Metric {
+	if len(names) == 0 {
+		return metrics
+	}
+	all := stringInSlice("all", names)
+	for i := range metrics {
+		if all || stringInSlice(metrics[i].Name, names) {
+			metrics[i].HighResolution = true
+		}
+	}
+	return metrics
+}
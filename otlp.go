@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otlpTimeout limits the duration of a single export.
+const otlpTimeout = 10 * time.Second
+
+// otlpCumulative is the AggregationTemporality of cumulative sums.
+const otlpCumulative = 2
+
+// otlpGRPCMethod is the path of the gRPC export method.
+const otlpGRPCMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// otlpSink exports the raw snapshots to an OpenTelemetry collector using
+// OTLP with protobuf encoding over HTTP or gRPC. Like the prometheus sink it
+// works on the snapshots, so the STATS_TOTALS counters are exported as
+// cumulative sums and the pools as gauges. The messages are encoded by hand
+// to avoid depending on the protobuf and OpenTelemetry libraries.
+//
+// The exports run on a single worker so a slow collector never stalls the
+// scrapes. Only the latest snapshot of each target is kept while the worker
+// is busy, the cumulative sums make dropping the older ones safe.
+type otlpSink struct {
+	client   *http.Client
+	endpoint string
+	grpc     bool
+
+	mu      sync.Mutex
+	series  map[string]*otlpSeries
+	pending map[*target][]byte
+	notify  chan struct{}
+}
+
+// otlpSeries tracks the start of the cumulative sums of a target, which
+// starts over whenever pgbouncer resets its counters.
+type otlpSeries struct {
+	start time.Time
+	stats DBStats
+}
+
+func newOTLPSink(cfg sinkConfig) (Sink, error) {
+	sink := &otlpSink{
+		client:   &http.Client{Timeout: otlpTimeout},
+		endpoint: cfg.otlpEndpoint,
+		series:   make(map[string]*otlpSeries),
+		pending:  make(map[*target][]byte),
+		notify:   make(chan struct{}, 1),
+	}
+
+	if err := checkOTLPProtocol(cfg.otlpProtocol, cfg.otlpEndpoint); err != nil {
+		return nil, err
+	}
+	if cfg.otlpProtocol == "grpc" {
+		sink.grpc = true
+		sink.endpoint = strings.TrimSuffix(cfg.otlpEndpoint, "/") + otlpGRPCMethod
+	}
+
+	go sink.run()
+	return sink, nil
+}
+
+// checkOTLPProtocol validates the protocol and endpoint flags, so a
+// collector which can't be used fails at startup.
+func checkOTLPProtocol(protocol string, endpoint string) error {
+	switch protocol {
+	case "", "http/protobuf":
+		return nil
+	case "grpc":
+		// net/http only speaks HTTP/2 over TLS
+		if !strings.HasPrefix(endpoint, "https://") {
+			return fmt.Errorf("plaintext gRPC is not supported, got %q: use an https:// endpoint or --otlp-protocol http/protobuf with the http:// endpoint of the collector (port 4318)", endpoint)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown OTLP protocol %q, expected http/protobuf or grpc", protocol)
+	}
+}
+
+func (o *otlpSink) Name() string {
+	return "otlp"
+}
+
+// Push is a no-op, the data is exported through Observe instead.
+func (o *otlpSink) Push(metrics []Metric) error {
+	return nil
+}
+
+// Observe queues the snapshot of the target for the export worker.
+func (o *otlpSink) Observe(t *target, point *statusPoint) {
+	now := time.Now()
+	start := o.start(t, point, now)
+	body := encodeOTLPRequest(prometheusFamilies(targetLabels(t), point), start, now)
+
+	o.mu.Lock()
+	if _, ok := o.pending[t]; ok {
+		t.logf("Previous OTLP export is still running, dropping the older snapshot")
+	}
+	o.pending[t] = body
+	o.mu.Unlock()
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run exports the queued snapshots until the process exits.
+func (o *otlpSink) run() {
+	for range o.notify {
+		o.mu.Lock()
+		pending := o.pending
+		o.pending = make(map[*target][]byte)
+		o.mu.Unlock()
+
+		for t, body := range pending {
+			if err := o.export(body); err != nil {
+				t.logf("Error exporting metrics to %s: %v", o.endpoint, err)
+			}
+		}
+	}
+}
+
+// start returns the start time of the cumulative sums of the target, the
+// process start time when known.
+func (o *otlpSink) start(t *target, point *statusPoint, now time.Time) time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	series, ok := o.series[t.Name]
+	if !ok {
+		series = &otlpSeries{start: now}
+		o.series[t.Name] = series
+	}
+	if point == nil {
+		return series.start
+	}
+
+	if _, reset := point.stats.getDelta(series.stats); reset && series.stats != nil {
+		series.start = now
+	}
+	if point.process != nil {
+		series.start = point.process.StartTime
+	}
+	series.stats = point.stats
+	return series.start
+}
+
+func (o *otlpSink) export(body []byte) error {
+	if o.grpc {
+		// Every gRPC message is prefixed with an uncompressed flag and its
+		// length.
+		frame := make([]byte, 5, 5+len(body))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+		body = append(frame, body...)
+	}
+
+	request, err := http.NewRequest("POST", o.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if o.grpc {
+		request.Header.Set("Content-Type", "application/grpc")
+		request.Header.Set("TE", "trailers")
+	} else {
+		request.Header.Set("Content-Type", "application/x-protobuf")
+	}
+
+	response, err := o.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	if o.grpc {
+		// Errors without a response body are sent in the headers instead of
+		// the trailers.
+		status, message := response.Trailer.Get("Grpc-Status"), response.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status, message = response.Header.Get("Grpc-Status"), response.Header.Get("Grpc-Message")
+		}
+		if status != "0" {
+			return fmt.Errorf("unexpected grpc status %q: %s", status, message)
+		}
+	}
+	return nil
+}
+
+// otlpResourceAttributes describes the instance running pgbouncer-cw.
+func otlpResourceAttributes() []Dimension {
+	attributes := []Dimension{{Name: "service.name", Value: "pgbouncer-cw"}}
+	if metadata.InstanceID != "" {
+		attributes = append(attributes,
+			Dimension{Name: "cloud.provider", Value: "aws"},
+			Dimension{Name: "host.id", Value: metadata.InstanceID})
+	}
+	if metadata.Region != "" {
+		attributes = append(attributes, Dimension{Name: "cloud.region", Value: metadata.Region})
+	}
+	return attributes
+}
+
+// encodeOTLPRequest encodes the families as an ExportMetricsServiceRequest,
+// counters become cumulative monotonic sums and everything else a gauge.
+func encodeOTLPRequest(families []prometheusFamily, start time.Time, timestamp time.Time) []byte {
+	var resource protoBuffer
+	for _, attribute := range otlpResourceAttributes() {
+		resource.message(1, encodeOTLPKeyValue(attribute))
+	}
+
+	var scope protoBuffer
+	scope.string(1, "pgbouncer-cw")
+
+	var scopeMetrics protoBuffer
+	scopeMetrics.message(1, scope.Bytes())
+	for _, family := range families {
+		scopeMetrics.message(2, encodeOTLPMetric(family, start, timestamp))
+	}
+
+	var resourceMetrics protoBuffer
+	resourceMetrics.message(1, resource.Bytes())
+	resourceMetrics.message(2, scopeMetrics.Bytes())
+
+	var request protoBuffer
+	request.message(1, resourceMetrics.Bytes())
+	return request.Bytes()
+}
+
+func encodeOTLPMetric(family prometheusFamily, start time.Time, timestamp time.Time) []byte {
+	var data protoBuffer
+	for _, sample := range family.samples {
+		var point protoBuffer
+		if family.kind == "counter" {
+			point.fixed64(2, uint64(start.UnixNano()))
+		}
+		point.fixed64(3, uint64(timestamp.UnixNano()))
+		point.fixed64(4, math.Float64bits(sample.value))
+		for _, label := range sample.labels {
+			point.message(7, encodeOTLPKeyValue(label))
+		}
+		data.message(1, point.Bytes())
+	}
+
+	var metric protoBuffer
+	metric.string(1, family.name)
+	metric.string(2, family.help)
+	if family.kind == "counter" {
+		data.varint(2, otlpCumulative)
+		data.varint(3, 1)
+		metric.message(7, data.Bytes())
+	} else {
+		metric.message(5, data.Bytes())
+	}
+	return metric.Bytes()
+}
+
+func encodeOTLPKeyValue(attribute Dimension) []byte {
+	var value protoBuffer
+	value.string(1, attribute.Value)
+
+	var keyValue protoBuffer
+	keyValue.string(1, attribute.Name)
+	keyValue.message(2, value.Bytes())
+	return keyValue.Bytes()
+}
+
+// protoBuffer writes fields in the protobuf wire format.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+const (
+	protoVarint    = 0
+	protoFixed64   = 1
+	protoDelimited = 2
+)
+
+func (p *protoBuffer) tag(field int, wireType int) {
+	p.writeVarint(uint64(field<<3 | wireType))
+}
+
+func (p *protoBuffer) writeVarint(value uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], value)
+	p.Write(buf[:n])
+}
+
+func (p *protoBuffer) varint(field int, value uint64) {
+	p.tag(field, protoVarint)
+	p.writeVarint(value)
+}
+
+func (p *protoBuffer) fixed64(field int, value uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], value)
+	p.tag(field, protoFixed64)
+	p.Write(buf[:])
+}
+
+func (p *protoBuffer) message(field int, value []byte) {
+	p.tag(field, protoDelimited)
+	p.writeVarint(uint64(len(value)))
+	p.Write(value)
+}
+
+func (p *protoBuffer) string(field int, value string) {
+	if value == "" {
+		return
+	}
+	p.message(field, []byte(value))
+}
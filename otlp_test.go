@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// protoFields decodes a protobuf message into the raw values per field,
+// varints and fixed64 values are returned as 8 little endian bytes.
+func protoFields(t *testing.T, data []byte) map[int][][]byte {
+	fields := make(map[int][][]byte)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		field, wireType := int(key>>3), int(key&7)
+
+		var value []byte
+		switch wireType {
+		case protoVarint:
+			v, n := binary.Uvarint(data)
+			data = data[n:]
+			value = make([]byte, 8)
+			binary.LittleEndian.PutUint64(value, v)
+		case protoFixed64:
+			value, data = data[:8], data[8:]
+		case protoDelimited:
+			length, n := binary.Uvarint(data)
+			data = data[n:]
+			value, data = data[:length], data[length:]
+		default:
+			t.Fatalf("unexpected wire type %d", wireType)
+		}
+		fields[field] = append(fields[field], value)
+	}
+	return fields
+}
+
+func TestEncodeOTLPRequest(t *testing.T) {
+	defer func(old instanceMetadata) { metadata = old }(metadata)
+	metadata.InstanceID = "i-1"
+	metadata.Region = "eu-west-1"
+
+	start := time.Unix(1500000000, 0)
+	timestamp := start.Add(time.Minute)
+	database := []Dimension{{Name: "database", Value: "test_1"}}
+	families := []prometheusFamily{
+		{name: "pgbouncer_queries_total", help: "Queries.", kind: "counter", samples: []prometheusSample{{database, 100}}},
+		{name: "pgbouncer_pool_client_waiting", help: "Waiting.", kind: "gauge", samples: []prometheusSample{{database, 2}}},
+	}
+
+	request := protoFields(t, encodeOTLPRequest(families, start, timestamp))
+	resourceMetrics := protoFields(t, request[1][0])
+
+	resource := protoFields(t, resourceMetrics[1][0])
+	var attributes []string
+	for _, attribute := range resource[1] {
+		keyValue := protoFields(t, attribute)
+		attributes = append(attributes, string(keyValue[1][0])+"="+string(protoFields(t, keyValue[2][0])[1][0]))
+	}
+	assert.Equal(t, []string{
+		"service.name=pgbouncer-cw", "cloud.provider=aws", "host.id=i-1", "cloud.region=eu-west-1",
+	}, attributes)
+
+	scopeMetrics := protoFields(t, resourceMetrics[2][0])
+	assert.Equal(t, "pgbouncer-cw", string(protoFields(t, scopeMetrics[1][0])[1][0]))
+	assert.Len(t, scopeMetrics[2], 2)
+
+	counter := protoFields(t, scopeMetrics[2][0])
+	assert.Equal(t, "pgbouncer_queries_total", string(counter[1][0]))
+	sum := protoFields(t, counter[7][0])
+	assert.Equal(t, uint64(otlpCumulative), binary.LittleEndian.Uint64(sum[2][0]))
+	assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(sum[3][0]))
+	point := protoFields(t, sum[1][0])
+	assert.Equal(t, uint64(start.UnixNano()), binary.LittleEndian.Uint64(point[2][0]))
+	assert.Equal(t, uint64(timestamp.UnixNano()), binary.LittleEndian.Uint64(point[3][0]))
+	assert.Equal(t, float64(100), math.Float64frombits(binary.LittleEndian.Uint64(point[4][0])))
+	assert.Equal(t, "database", string(protoFields(t, point[7][0])[1][0]))
+
+	gauge := protoFields(t, scopeMetrics[2][1])
+	assert.Equal(t, "pgbouncer_pool_client_waiting", string(gauge[1][0]))
+	assert.Nil(t, gauge[7])
+	point = protoFields(t, protoFields(t, gauge[5][0])[1][0])
+	assert.Nil(t, point[2])
+	assert.Equal(t, float64(2), math.Float64frombits(binary.LittleEndian.Uint64(point[4][0])))
+}
+
+type otlpRequest struct {
+	path        string
+	contentType string
+	body        []byte
+}
+
+func TestOTLPSinkObserve(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- otlpRequest{r.URL.Path, r.Header.Get("Content-Type"), body}
+	}))
+	defer server.Close()
+
+	sink, err := newOTLPSink(sinkConfig{otlpEndpoint: server.URL + "/v1/metrics"})
+	assert.Nil(t, err)
+	o := sink.(*otlpSink)
+
+	first := time.Now()
+	o.Observe(&target{Name: "main"}, &statusPoint{stats: DBStats{"test_1": Stats{Database: "test_1", QueryCount: 10}}})
+	select {
+	case request := <-requests:
+		assert.Equal(t, "/v1/metrics", request.path)
+		assert.Equal(t, "application/x-protobuf", request.contentType)
+		assert.NotEmpty(t, request.body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no export received")
+	}
+
+	// The cumulative sums only start over after a counter reset
+	start := o.series["main"].start
+	assert.False(t, start.Before(first))
+	o.start(&target{Name: "main"}, &statusPoint{stats: DBStats{"test_1": Stats{Database: "test_1", QueryCount: 20}}}, first.Add(time.Minute))
+	assert.Equal(t, start, o.series["main"].start)
+	o.start(&target{Name: "main"}, &statusPoint{stats: DBStats{"test_1": Stats{Database: "test_1", QueryCount: 5}}}, first.Add(2*time.Minute))
+	assert.Equal(t, first.Add(2*time.Minute), o.series["main"].start)
+}
+
+func TestOTLPSinkObserveBusy(t *testing.T) {
+	o := &otlpSink{pending: make(map[*target][]byte), series: make(map[string]*otlpSeries), notify: make(chan struct{}, 1)}
+	main := &target{Name: "main"}
+
+	// Without a worker only the latest snapshot of the target is kept
+	o.Observe(main, &statusPoint{})
+	o.Observe(main, nil)
+	o.Observe(&target{Name: "other"}, nil)
+	assert.Len(t, o.pending, 2)
+	assert.Len(t, o.notify, 1)
+}
+
+func TestOTLPSinkGRPC(t *testing.T) {
+	status := "0"
+	requests := make(chan otlpRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- otlpRequest{r.URL.Path, r.Header.Get("Content-Type"), body}
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", status)
+		w.Header().Set("Grpc-Message", "unavailable")
+	}))
+	defer server.Close()
+
+	// The sink is created directly since the test server doesn't use TLS
+	o := &otlpSink{client: server.Client(), endpoint: server.URL + otlpGRPCMethod, grpc: true}
+	assert.Nil(t, o.export([]byte{1, 2, 3}))
+	request := <-requests
+	assert.Equal(t, otlpGRPCMethod, request.path)
+	assert.Equal(t, "application/grpc", request.contentType)
+	assert.Equal(t, []byte{0, 0, 0, 0, 3, 1, 2, 3}, request.body)
+
+	status = "14"
+	assert.EqualError(t, o.export([]byte{1}), `unexpected grpc status "14": unavailable`)
+	<-requests
+}
+
+func TestNewOTLPSinkProtocol(t *testing.T) {
+	sink, err := newOTLPSink(sinkConfig{otlpEndpoint: "https://collector:4317/", otlpProtocol: "grpc"})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://collector:4317"+otlpGRPCMethod, sink.(*otlpSink).endpoint)
+
+	_, err = newOTLPSink(sinkConfig{otlpEndpoint: "http://collector:4317", otlpProtocol: "grpc"})
+	assert.EqualError(t, err, `plaintext gRPC is not supported, got "http://collector:4317": use an https:// endpoint or --otlp-protocol http/protobuf with the http:// endpoint of the collector (port 4318)`)
+	assert.NotNil(t, checkOTLPProtocol("grpc", "localhost:4317"))
+	assert.Nil(t, checkOTLPProtocol("http/protobuf", "http://localhost:4318/v1/metrics"))
+
+	_, err = newOTLPSink(sinkConfig{otlpProtocol: "http/json"})
+	assert.EqualError(t, err, `unknown OTLP protocol "http/json", expected http/protobuf or grpc`)
+}
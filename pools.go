@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
+	"math"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -20,27 +21,98 @@ type Pool struct {
 	MaxWait        float64 `db:"maxwait"`
 	MaxWaitUs      float64 `db:"maxwait_us"`
 	PoolMode       string  `db:"pool_mode"`
-	TimeStamp      time.Time
-	IsAggregated   bool
+	// Extra holds the gauges of columns added by newer pgbouncer versions
+	Extra        map[string]float64 `db:"-"`
+	TimeStamp    time.Time
+	IsAggregated bool
 }
 
-type DBPools map[string]Pool
-
-func (p *Pool) add(o Pool) {
-	p.ClientsActive += o.ClientsActive
-	p.ClientsWaiting += o.ClientsWaiting
-	p.ServersActive += o.ServersActive
-	p.ServersIdle += o.ServersIdle
-	p.ServersUsed += o.ServersUsed
-	p.ServersTested += o.ServersTested
-	p.ServersLogin += o.ServersLogin
-	p.MaxWait += o.MaxWait
-	p.MaxWaitUs += o.MaxWaitUs
+// poolKey identifies a pool, pgbouncer creates a separate pool for every
+// database and user pair.
+type poolKey struct {
+	Database string
+	User     string
 }
 
-func getPoolData(db *sqlx.DB) (DBPools, error) {
+type DBPools map[poolKey]Pool
+
+// addMetricData adds the metrics of every pool and of the totals per
+// database.
+func (d DBPools) addMetricData(dest []Metric) []Metric {
+	for _, pool := range d {
+		dest = pool.addMetricData(dest)
+	}
+	for _, pool := range d.databaseTotals() {
+		dest = pool.addMetricData(dest)
+	}
+	return dest
+}
+
+// databaseTotals sums the pools of all users per database. The aggregated
+// pool is skipped.
+func (d DBPools) databaseTotals() DBPools {
+	result := make(DBPools)
+	for _, pool := range d {
+		if pool.IsAggregated {
+			continue
+		}
+		key := poolKey{Database: pool.Database}
+		total, ok := result[key]
+		if !ok {
+			total = Pool{
+				Database:  pool.Database,
+				PoolMode:  pool.PoolMode,
+				TimeStamp: pool.TimeStamp,
+			}
+		}
+		total.aggregate(pool)
+		if total.PoolMode != pool.PoolMode {
+			total.PoolMode = ""
+		}
+		result[key] = total
+	}
+	return result
+}
+
+// poolAggregations declares how the pools are combined into the totals per
+// database and across all databases.
+var poolAggregations = map[string]aggregation{
+	"ClientsActive":  aggregateSum,
+	"ClientsWaiting": aggregateSum,
+	"ServersActive":  aggregateSum,
+	"ServersIdle":    aggregateSum,
+	"ServersUsed":    aggregateSum,
+	"ServersTested":  aggregateSum,
+	"ServersLogin":   aggregateSum,
+	"MaxWait":        aggregateMax,
+}
+
+// aggregate combines the pool o into p using poolAggregations.
+func (p *Pool) aggregate(o Pool) {
+	p.ClientsActive = poolAggregations["ClientsActive"].aggregate(p.ClientsActive, 0, o.ClientsActive, 0)
+	p.ClientsWaiting = poolAggregations["ClientsWaiting"].aggregate(p.ClientsWaiting, 0, o.ClientsWaiting, 0)
+	p.ServersActive = poolAggregations["ServersActive"].aggregate(p.ServersActive, 0, o.ServersActive, 0)
+	p.ServersIdle = poolAggregations["ServersIdle"].aggregate(p.ServersIdle, 0, o.ServersIdle, 0)
+	p.ServersUsed = poolAggregations["ServersUsed"].aggregate(p.ServersUsed, 0, o.ServersUsed, 0)
+	p.ServersTested = poolAggregations["ServersTested"].aggregate(p.ServersTested, 0, o.ServersTested, 0)
+	p.ServersLogin = poolAggregations["ServersLogin"].aggregate(p.ServersLogin, 0, o.ServersLogin, 0)
+
+	// maxwait and maxwait_us together make up a single value
+	maxWait := poolAggregations["MaxWait"].aggregate(p.maxWaitSeconds(), 0, o.maxWaitSeconds(), 0)
+	p.MaxWait = math.Floor(maxWait)
+	p.MaxWaitUs = math.Round((maxWait - p.MaxWait) * 1000000)
+
+	// The extra columns are all gauges of connections
+	p.Extra = addExtra(p.Extra, o.Extra)
+}
+
+func getPoolData(ctx context.Context, db *sqlx.DB) (DBPools, error) {
 	var pools []Pool
-	err := db.Select(&pools, `SHOW POOLS`)
+	err := selectColumns(ctx, db, `SHOW POOLS`, func(row columnValues) {
+		var item Pool
+		item.Extra = row.assign(db, &item)
+		pools = append(pools, item)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -48,64 +120,80 @@ func getPoolData(db *sqlx.DB) (DBPools, error) {
 	dbPools := make(DBPools)
 	total := Pool{IsAggregated: true, TimeStamp: time.Now()}
 	for _, item := range pools {
-		total.add(item)
+		total.aggregate(item)
 		item.TimeStamp = time.Now()
-		dbPools[item.Database] = item
+		dbPools[poolKey{item.Database, item.User}] = item
 	}
-	dbPools[total.Database] = total
+	dbPools[poolKey{}] = total
 	return dbPools, nil
 }
 
-func (p *Pool) addMetricData(dest []cloudwatch.MetricDatum) []cloudwatch.MetricDatum {
+// poolMetricNames lists all metrics which can be published for a pool, in
+// the order they are published.
+var poolMetricNames = []string{
+	"ClientsActive",
+	"ClientsWaiting",
+	"ServersActive",
+	"ServersIdle",
+	"ServersUsed",
+	"ServersTested",
+	"ServersLogin",
+	"MaxWait",
+}
+
+// maxWaitSeconds returns the age of the oldest waiting client, maxwait only
+// holds whole seconds so the microseconds part is added to it.
+func (p *Pool) maxWaitSeconds() float64 {
+	return p.MaxWait + p.MaxWaitUs/1000000
+}
+
+func (p *Pool) addMetricData(dest []Metric) []Metric {
 
-	items := map[string]struct {
-		value float64
-		unit  cloudwatch.StandardUnit
-	}{
-		"ServersIdle":   {p.ServersIdle, cloudwatch.StandardUnitCount},
-		"ServersActive": {p.ServersActive, cloudwatch.StandardUnitCount},
+	items := map[string]metricValue{
+		"ClientsActive":  {p.ClientsActive, UnitCount},
+		"ClientsWaiting": {p.ClientsWaiting, UnitCount},
+		"ServersActive":  {p.ServersActive, UnitCount},
+		"ServersIdle":    {p.ServersIdle, UnitCount},
+		"ServersUsed":    {p.ServersUsed, UnitCount},
+		"ServersTested":  {p.ServersTested, UnitCount},
+		"ServersLogin":   {p.ServersLogin, UnitCount},
+		"MaxWait":        {p.maxWaitSeconds(), UnitSeconds},
 	}
 
-	if p.IsAggregated {
-		dimension := cloudwatch.Dimension{
-			Name:  stringPtr("Across all instances"),
-			Value: stringPtr("instances"),
+	// The extra columns are only published when no selection was made
+	metricItems := metadata.poolMetrics
+	if metricItems == nil {
+		metricItems = append([]string{}, poolMetricNames...)
+		for _, key := range sortedExtraKeys(p.Extra) {
+			name := columnMetricName(key)
+			items[name] = metricValue{p.Extra[key], UnitCount}
+			metricItems = append(metricItems, name)
 		}
-		for key, item := range items {
-			dest = append(dest, p.createMetricDatum(key, item.value, item.unit, dimension))
+	}
+
+	if p.IsAggregated {
+		dimension := Dimension{Name: "Across all instances", Value: "instances"}
+		for _, key := range metricItems {
+			dest = append(dest, newMetric(key, items[key].value, items[key].unit, p.TimeStamp, dimension))
 		}
 
-		dimension = cloudwatch.Dimension{
-			Name:  stringPtr("InstanceId"),
-			Value: stringPtr(metadata.InstanceID),
+		dimension = Dimension{Name: "InstanceId", Value: metadata.InstanceID}
+		for _, key := range metricItems {
+			dest = append(dest, newMetric(key, items[key].value, items[key].unit, p.TimeStamp, dimension))
 		}
-		for key, item := range items {
-			dest = append(dest, p.createMetricDatum(key, item.value, item.unit, dimension))
+	} else if p.User == "" {
+		dimension := Dimension{Name: "Database", Value: p.Database}
+		for _, key := range metricItems {
+			dest = append(dest, newMetric(key, items[key].value, items[key].unit, p.TimeStamp, dimension))
 		}
 	} else {
-		dimension := cloudwatch.Dimension{
-			Name:  stringPtr("Database"),
-			Value: stringPtr(p.Database),
+		dimensions := []Dimension{
+			{Name: "Database", Value: p.Database},
+			{Name: "User", Value: p.User},
 		}
-
-		for key, item := range items {
-			dest = append(dest, p.createMetricDatum(key, item.value, item.unit, dimension))
+		for _, key := range metricItems {
+			dest = append(dest, newMetric(key, items[key].value, items[key].unit, p.TimeStamp, dimensions...))
 		}
 	}
 	return dest
 }
-
-func (p *Pool) createMetricDatum(
-	name string,
-	value float64,
-	unit cloudwatch.StandardUnit,
-	dimension cloudwatch.Dimension,
-) cloudwatch.MetricDatum {
-	return cloudwatch.MetricDatum{
-		MetricName: &name,
-		Dimensions: []cloudwatch.Dimension{dimension},
-		Timestamp:  &p.TimeStamp,
-		Unit:       unit,
-		Value:      &value,
-	}
-}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"testing"
 
 	"github.com/jmoiron/sqlx"
@@ -25,11 +26,11 @@ func TestGetPoolData(t *testing.T) {
 
 	sqlxDB := sqlx.NewDb(db, "sqlmock")
 
-	stats, err := getPoolData(sqlxDB)
+	stats, err := getPoolData(context.Background(), sqlxDB)
 	assert.Equal(t, nil, err)
 
 	expected := DBPools{
-		"test_1": Pool{
+		poolKey{"test_1", "client_1"}: Pool{
 			Database:       "test_1",
 			User:           "client_1",
 			ClientsActive:  3,
@@ -42,10 +43,10 @@ func TestGetPoolData(t *testing.T) {
 			MaxWait:        10,
 			MaxWaitUs:      11,
 			PoolMode:       "transaction",
-			TimeStamp:      stats["test_1"].TimeStamp,
+			TimeStamp:      stats[poolKey{"test_1", "client_1"}].TimeStamp,
 			IsAggregated:   false,
 		},
-		"test_2": Pool{
+		poolKey{"test_2", "client_2"}: Pool{
 			Database:       "test_2",
 			User:           "client_2",
 			ClientsActive:  13,
@@ -58,10 +59,10 @@ func TestGetPoolData(t *testing.T) {
 			MaxWait:        110,
 			MaxWaitUs:      111,
 			PoolMode:       "transaction",
-			TimeStamp:      stats["test_2"].TimeStamp,
+			TimeStamp:      stats[poolKey{"test_2", "client_2"}].TimeStamp,
 			IsAggregated:   false,
 		},
-		"": Pool{
+		poolKey{}: Pool{
 			Database:       "",
 			User:           "",
 			ClientsActive:  16,
@@ -71,12 +72,106 @@ func TestGetPoolData(t *testing.T) {
 			ServersUsed:    24,
 			ServersTested:  26,
 			ServersLogin:   28,
-			MaxWait:        120,
-			MaxWaitUs:      122,
+			MaxWait:        110,
+			MaxWaitUs:      111,
 			PoolMode:       "",
-			TimeStamp:      stats[""].TimeStamp,
+			TimeStamp:      stats[poolKey{}].TimeStamp,
 			IsAggregated:   true,
 		}}
 
 	assert.Equal(t, expected, stats)
 }
+
+func TestGetPoolDataMultipleUsers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{
+		"database", "user", "cl_active", "cl_waiting", "sv_active", "sv_idle",
+		"sv_used", "sv_tested", "sv_login", "maxwait", "maxwait_us", "pool_mode",
+	}).
+		AddRow("test_1", "app", 3, 4, 5, 6, 7, 8, 9, 10, 11, "transaction").
+		AddRow("test_1", "migrate", 1, 0, 1, 0, 0, 0, 0, 0, 0, "transaction")
+	mock.ExpectQuery("SHOW POOLS").WillReturnRows(rows)
+
+	pools, err := getPoolData(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(pools))
+	assert.Equal(t, float64(3), pools[poolKey{"test_1", "app"}].ClientsActive)
+	assert.Equal(t, float64(1), pools[poolKey{"test_1", "migrate"}].ClientsActive)
+
+	totals := pools.databaseTotals()
+	assert.Equal(t, 1, len(totals))
+
+	total := totals[poolKey{Database: "test_1"}]
+	assert.Equal(t, "test_1", total.Database)
+	assert.Equal(t, "", total.User)
+	assert.Equal(t, "transaction", total.PoolMode)
+	assert.Equal(t, float64(4), total.ClientsActive)
+	assert.Equal(t, float64(6), total.ServersActive)
+	assert.False(t, total.IsAggregated)
+}
+
+func TestPoolAddMetricDataUserDimension(t *testing.T) {
+	pool := Pool{Database: "test_1", User: "app", ServersActive: 2}
+
+	metrics := pool.addMetricData(nil)
+	assert.Equal(t, len(poolMetricNames), len(metrics))
+	for _, metric := range metrics {
+		assert.Equal(t, []Dimension{{"Database", "test_1"}, {"User", "app"}}, metric.Dimensions)
+	}
+}
+
+func TestPoolAddMetricDataSelection(t *testing.T) {
+	metadata.poolMetrics = []string{"ClientsWaiting", "MaxWait"}
+	defer func() { metadata.poolMetrics = nil }()
+
+	pool := Pool{Database: "test_1", ClientsWaiting: 3, MaxWait: 2, MaxWaitUs: 250000}
+
+	metrics := pool.addMetricData(nil)
+	assert.Equal(t, 2, len(metrics))
+	assert.Equal(t, "ClientsWaiting", metrics[0].Name)
+	assert.Equal(t, float64(3), metrics[0].Value)
+	assert.Equal(t, UnitCount, metrics[0].Unit)
+	assert.Equal(t, "MaxWait", metrics[1].Name)
+	assert.Equal(t, 2.25, metrics[1].Value)
+	assert.Equal(t, UnitSeconds, metrics[1].Unit)
+}
+
+func TestPoolAggregateMaxWait(t *testing.T) {
+	pool := Pool{ClientsWaiting: 1, MaxWait: 2, MaxWaitUs: 500000}
+	pool.aggregate(Pool{ClientsWaiting: 2, MaxWait: 1, MaxWaitUs: 900000})
+	pool.aggregate(Pool{ClientsWaiting: 3, MaxWait: 2, MaxWaitUs: 750000})
+
+	assert.Equal(t, float64(6), pool.ClientsWaiting)
+	assert.Equal(t, float64(2), pool.MaxWait)
+	assert.Equal(t, float64(750000), pool.MaxWaitUs)
+}
+
+func TestGetPoolDataExtraColumns(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{
+		"database", "user", "cl_active", "cl_waiting", "cl_active_cancel_req", "sv_active",
+		"sv_idle", "sv_used", "sv_tested", "sv_login", "maxwait", "maxwait_us", "pool_mode",
+		"load_balance_hosts",
+	}).
+		AddRow("test_1", "app", 3, 4, 2, 5, 6, 7, 8, 9, 0, 0, "transaction", nil)
+	mock.ExpectQuery("SHOW POOLS").WillReturnRows(rows)
+
+	pools, err := getPoolData(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{"cl_active_cancel_req": 2}, pools[poolKey{"test_1", "app"}].Extra)
+	assert.Equal(t, map[string]float64{"cl_active_cancel_req": 2}, pools[poolKey{}].Extra)
+
+	pool := pools[poolKey{"test_1", "app"}]
+	metrics := pool.addMetricData(nil)
+	assert.Equal(t, "ClActiveCancelReq", metrics[len(metrics)-1].Name)
+}
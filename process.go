@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"log"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -13,82 +14,333 @@ type statusLog struct {
 }
 
 type statusPoint struct {
-	stats DBStats
-	pools DBPools
+	stats     DBStats
+	pools     DBPools
+	lists     *Lists
+	databases DBDatabases
+	clients   []ClientGroup
+	servers   DBServers
+	internals *Internals
+	samples   metricSamples
+	process   *Process
+	config    PGBouncerConfig
 }
 
-func getData(db *sqlx.DB) (*statusPoint, error) {
+func getData(ctx context.Context, db *sqlx.DB, version pgbouncerVersion) (*statusPoint, error) {
 	status := statusPoint{}
-	stats, err := getStatsData(db)
+	stats, err := getStatsData(ctx, db, version)
 	if err != nil {
 		return nil, err
 	}
 	status.stats = stats
 
-	if metadata.detailedMonitoring {
-		pools, err := getPoolData(db)
+	config, err := getConfigData(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	status.config = config
+
+	lists, err := getListsData(ctx, db, config)
+	if err != nil {
+		return nil, err
+	}
+	status.lists = lists
+
+	// The snapshot sinks publish the pools also without detailed monitoring
+	if metadata.detailedMonitoring || metadata.collectPools {
+		pools, err := getPoolData(ctx, db)
 		if err != nil {
 			return nil, err
 		}
 		status.pools = pools
+
+		databases, err := getDatabaseData(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		status.databases = databases
+	}
+
+	if metadata.collectClients {
+		clients, err := getClientData(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		status.clients = clients
+	}
+
+	if metadata.collectServers {
+		servers, err := getServerData(ctx, db, config)
+		if err != nil {
+			return nil, err
+		}
+		status.servers = servers
+	}
+
+	if metadata.collectInternals {
+		internals, err := getInternalsData(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		status.internals = internals
+	}
+
+	// The process may not be visible from here, which should not stop the
+	// rest of the metrics from being published.
+	if metadata.collectProcess {
+		process, err := getProcessData(config)
+		if err != nil {
+			log.Printf("Unable to sample the pgbouncer process: %v", err)
+		}
+		status.process = process
 	}
-	return &status, err
+	return &status, nil
 }
 
-func processStats(previous statusPoint, current statusPoint) []cloudwatch.MetricDatum {
+func processStats(previous statusPoint, current statusPoint) []Metric {
 
-	var metrics []cloudwatch.MetricDatum
+	var metrics []Metric
 
 	// Generate metrics for delta of stats
-	deltas := current.stats.getDelta(previous.stats)
+	deltas, reset := statsDelta(previous, current)
 	for _, stats := range deltas {
 		metrics = stats.addMetricData(metrics)
 	}
 
+	if isRestarted(previous, current) {
+		log.Println("Detected a new pgbouncer process, pgbouncer was restarted")
+		metrics = addRestartMetricData(metrics, time.Now())
+	} else if reset {
+		log.Println("Detected a counter reset, assuming pgbouncer was restarted")
+		metrics = addRestartMetricData(metrics, time.Now())
+	}
+
+	// Generate metrics for the settings
+	metrics = current.config.addMetricData(metrics, previous.config, time.Now())
+
+	// Generate metrics for the connection slots
+	if current.lists != nil {
+		metrics = current.lists.addMetricData(metrics)
+	}
+
 	// Generate metrics for pools
 	if metadata.detailedMonitoring {
-		for _, pool := range current.pools {
-			metrics = pool.addMetricData(metrics)
+		metrics = current.pools.addMetricData(metrics)
+		for _, database := range current.databases {
+			metrics = database.addMetricData(metrics, current.pools)
 		}
 	}
+
+	// Generate metrics for the server connections
+	if current.servers != nil {
+		metrics = current.servers.addMetricData(metrics, previous.servers)
+	}
+
+	// Generate metrics for the memory caches and file descriptors
+	if current.internals != nil {
+		metrics = current.internals.addMetricData(metrics)
+	}
+
+	// Generate metrics for the pgbouncer process
+	if current.process != nil {
+		metrics = current.process.addMetricData(metrics, previous.process)
+	}
+
+	// Generate metrics for the client groups
+	for _, group := range current.clients {
+		metrics = group.addMetricData(metrics)
+	}
+
+	// Replace the gauges sampled within the interval by their statistics
+	return current.samples.apply(metrics)
+}
+
+// isRestarted returns true when the process start time changed between the
+// snapshots. This catches restarts between two scrapes where the counters
+// already grew past their previous values.
+func isRestarted(previous statusPoint, current statusPoint) bool {
+	return current.process != nil && current.process.isRestarted(previous.process)
+}
+
+// statsDelta returns the rates of the stats since previous. After a restart
+// the counters started from zero, also when they didn't go backwards.
+func statsDelta(previous statusPoint, current statusPoint) (DBStats, bool) {
+	if isRestarted(previous, current) {
+		deltas, _ := current.stats.getDelta(previous.stats.zeroed())
+		return deltas, true
+	}
+	return current.stats.getDelta(previous.stats)
+}
+
+// addRestartMetricData adds the Restarts event metric, emitted whenever a
+// counter reset was detected.
+func addRestartMetricData(dest []Metric, timestamp time.Time) []Metric {
+	dimensions := []Dimension{
+		{Name: "Across all instances", Value: "instances"},
+		{Name: "InstanceId", Value: metadata.InstanceID},
+	}
+	for _, dimension := range dimensions {
+		dest = append(dest, newMetric("Restarts", 1, UnitCount, timestamp, dimension))
+	}
+	return dest
+}
+
+// processTotals combines the totals of all targets into the host level
+// metrics.
+func processTotals(targets []*target) []Metric {
+	var stats *Stats
+	var pool *Pool
+	var lists *Lists
+
+	for _, t := range targets {
+		previous, current := t.status.previous, t.status.current
+		if previous == nil || current == nil {
+			continue
+		}
+
+		deltas, _ := statsDelta(*previous, *current)
+		if total, ok := deltas[""]; ok {
+			if stats == nil {
+				stats = &total
+			} else {
+				stats.aggregate(total)
+			}
+		}
+
+		if total, ok := current.pools[poolKey{}]; ok {
+			if pool == nil {
+				pool = &total
+			} else {
+				pool.aggregate(total)
+			}
+		}
+
+		if current.lists != nil {
+			if lists == nil {
+				total := *current.lists
+				lists = &total
+			} else {
+				lists.aggregate(*current.lists)
+			}
+		}
+	}
+
+	var metrics []Metric
+	if stats != nil {
+		metrics = stats.addMetricData(metrics)
+	}
+	if lists != nil {
+		metrics = lists.addMetricData(metrics)
+	}
+	if pool != nil && metadata.detailedMonitoring {
+		metrics = pool.addMetricData(metrics)
+	}
 	return metrics
 }
 
-func collectStats(databaseURL string, namespace string, status *statusLog, svc *cloudwatch.CloudWatch) {
-	db, err := newDB(databaseURL)
-	if err != nil {
-		log.Print("Error connecting to database:", err)
-		return
+// withDimensions adds the dimensions to each of the metrics.
+func withDimensions(metrics []Metric, dimensions []Dimension) []Metric {
+	if len(dimensions) == 0 {
+		return metrics
 	}
-	status.current, err = getData(db)
-	if err != nil {
-		log.Print("Error connecting to database:", err)
-		return
+	for i := range metrics {
+		result := make([]Dimension, 0, len(metrics[i].Dimensions)+len(dimensions))
+		result = append(result, metrics[i].Dimensions...)
+		metrics[i].Dimensions = append(result, dimensions...)
+	}
+	return metrics
+}
+
+type scrapeResult struct {
+	target *target
+	point  *statusPoint
+	err    error
+}
+
+// scrapeTargets retrieves the data of all targets concurrently. Targets
+// which didn't finish before the scrape timeout are skipped, they release
+// themselves once their queries return.
+func scrapeTargets(targets []*target) {
+	ctx := context.Background()
+	if metadata.scrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, metadata.scrapeTimeout)
+		defer cancel()
 	}
-	db.Close()
 
-	if status.previous != nil && status.current != nil {
-		metrics := processStats(*status.previous, *status.current)
-		pushMetrics(svc, namespace, metrics)
+	results := make(chan scrapeResult, len(targets))
+	pending := 0
+	for _, t := range targets {
+		if !t.tryAcquire() {
+			t.logf("Previous scrape is still running, skipping")
+			continue
+		}
+		pending++
+		go func(t *target) {
+			defer t.release()
+			point, err := t.scrape(ctx)
+			results <- scrapeResult{t, point, err}
+		}(t)
 	}
 
-	status.previous = status.current
-	status.current = nil
+	for ; pending > 0; pending-- {
+		select {
+		case result := <-results:
+			if result.err != nil {
+				result.target.logf("Error collecting data: %v", result.err)
+				continue
+			}
+			result.target.status.current = result.point
+		case <-ctx.Done():
+			log.Printf("Scrape timed out, skipping %d target(s)\n", pending)
+			return
+		}
+	}
 }
 
-func pushMetrics(svc *cloudwatch.CloudWatch, namespace string, metrics []cloudwatch.MetricDatum) {
-	log.Printf(
-		"Pushing %d metrics to CloudWatch Metrics (InstanceID '%s')\n",
-		len(metrics), metadata.InstanceID)
-
-	for i := 0; i < len(metrics); i += 20 {
-		request := svc.PutMetricDataRequest(&cloudwatch.PutMetricDataInput{
-			MetricData: metrics[i:min(i+20, len(metrics))],
-			Namespace:  &namespace,
-		})
-		_, err := request.Send()
-		if err != nil {
-			log.Println(err)
+// nextRun returns the first run after now on the schedule started by
+// previous, so the time spent collecting doesn't shift the interval. Runs
+// which were missed are skipped.
+func nextRun(previous time.Time, interval time.Duration, now time.Time) time.Time {
+	next := previous.Add(interval)
+	for !next.After(now) {
+		next = next.Add(interval)
+	}
+	return next
+}
+
+func collectStats(targets []*target, sinks []Sink) {
+	scrapeTargets(targets)
+
+	var metrics []Metric
+	for _, t := range targets {
+		observeSnapshot(sinks, t, t.status.current)
+		if t.status.previous != nil && t.status.current != nil {
+			metrics = append(metrics, withDimensions(
+				processStats(*t.status.previous, *t.status.current), t.dimensions())...)
+			t.logConfigChanges()
 		}
 	}
+
+	// The totals of a target without a name are already the host totals.
+	if len(targets) > 1 || targets[0].Name != "" {
+		metrics = append(metrics, processTotals(targets)...)
+	}
+
+	// Everything is published with a high resolution during a burst
+	now := time.Now()
+	checkBurst(targets, now)
+	highResolution := metadata.highResolutionMetrics
+	if burst.active(now) {
+		highResolution = []string{"all"}
+	}
+
+	if len(metrics) > 0 {
+		pushMetrics(sinks, markHighResolution(metrics, highResolution))
+	}
+
+	for _, t := range targets {
+		t.status.previous = t.status.current
+		t.status.current = nil
+	}
 }
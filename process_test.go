@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"testing"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
 
 func TestProcessStats(t *testing.T) {
@@ -35,7 +38,7 @@ func TestProcessStats(t *testing.T) {
 			},
 		},
 		pools: DBPools{
-			"test_1": Pool{
+			poolKey{"test_1", "client_1"}: Pool{
 				Database:       "test_1",
 				User:           "client_1",
 				ClientsActive:  3,
@@ -78,7 +81,7 @@ func TestProcessStats(t *testing.T) {
 			},
 		},
 		pools: DBPools{
-			"test_1": Pool{
+			poolKey{"test_1", "client_1"}: Pool{
 				Database:       "test_1",
 				User:           "client_1",
 				ClientsActive:  3,
@@ -96,5 +99,154 @@ func TestProcessStats(t *testing.T) {
 	}
 
 	result := processStats(previous, current)
-	assert.Equal(t, 8, len(result))
+	assert.Equal(t, 44, len(result))
+	for _, metric := range result {
+		assert.Contains(t, metricNames, metric.Name)
+	}
+}
+
+func TestProcessStatsRestart(t *testing.T) {
+	metadata.detailedMonitoring = false
+	now := time.Now()
+	previous := statusPoint{
+		stats: DBStats{
+			"test_1": Stats{Database: "test_1", QueryCount: 100, TimeStamp: now.Add(-time.Minute)},
+		},
+	}
+	current := statusPoint{
+		stats: DBStats{
+			"test_1": Stats{Database: "test_1", QueryCount: 60, TimeStamp: now},
+		},
+	}
+
+	result := processStats(previous, current)
+
+	restarts := 0
+	for _, metric := range result {
+		if metric.Name == "Restarts" {
+			restarts++
+			assert.Equal(t, float64(1), metric.Value)
+		}
+		assert.True(t, metric.Value >= 0)
+	}
+	assert.Equal(t, 2, restarts)
+}
+
+func TestWithDimensions(t *testing.T) {
+	shared := []Dimension{{"Database", "test"}}
+	metrics := []Metric{
+		{Name: "QueryCount", Dimensions: shared},
+		{Name: "QueryTime", Dimensions: shared},
+	}
+
+	result := withDimensions(metrics, []Dimension{{"Target", "a"}})
+
+	for _, metric := range result {
+		assert.Equal(t, []Dimension{{"Database", "test"}, {"Target", "a"}}, metric.Dimensions)
+	}
+	assert.Equal(t, []Dimension{{"Database", "test"}}, shared)
+}
+
+func TestProcessTotals(t *testing.T) {
+	metadata.detailedMonitoring = true
+	now := time.Now()
+	newTarget := func(name string, queries, maxWait float64) *target {
+		return &target{
+			Name: name,
+			status: statusLog{
+				previous: &statusPoint{
+					stats: DBStats{"db": Stats{Database: "db", TimeStamp: now.Add(-10 * time.Second)}},
+				},
+				current: &statusPoint{
+					stats: DBStats{"db": Stats{Database: "db", QueryCount: queries, TimeStamp: now}},
+					pools: DBPools{poolKey{}: Pool{IsAggregated: true, ClientsWaiting: 1, MaxWait: maxWait}},
+					lists: &Lists{UsedClients: 10, MaxClientConn: 100},
+				},
+			},
+		}
+	}
+	targets := []*target{newTarget("a", 100, 3), newTarget("b", 300, 5)}
+
+	values := make(map[string]float64)
+	for _, metric := range processTotals(targets) {
+		if metric.Dimensions[0].Name == "InstanceId" {
+			values[metric.Name] = metric.Value
+		}
+	}
+
+	assert.Equal(t, float64(40), values["QueryCount"])
+	assert.Equal(t, float64(2), values["ClientsWaiting"])
+	assert.Equal(t, float64(5), values["MaxWait"])
+	assert.Equal(t, float64(20), values["UsedClients"])
+	assert.Equal(t, float64(10), values["ClientConnectionUtilization"])
+}
+
+func TestNextRun(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The time spent collecting doesn't shift the schedule
+	assert.Equal(t, start.Add(10*time.Second), nextRun(start, 10*time.Second, start.Add(3*time.Second)))
+
+	// Missed runs are skipped
+	assert.Equal(t, start.Add(30*time.Second), nextRun(start, 10*time.Second, start.Add(25*time.Second)))
+	assert.Equal(t, start.Add(20*time.Second), nextRun(start, 10*time.Second, start.Add(10*time.Second)))
+}
+
+func TestProcessStatsRestartedProcess(t *testing.T) {
+	start := time.Now()
+	previous := statusPoint{
+		stats:   DBStats{"test_1": Stats{Database: "test_1", QueryCount: 100, TimeStamp: start}},
+		process: &Process{Pid: 10, StartTime: start.Add(-time.Hour)},
+	}
+	current := statusPoint{
+		stats:   DBStats{"test_1": Stats{Database: "test_1", QueryCount: 700, TimeStamp: start.Add(time.Minute)}},
+		process: &Process{Pid: 12, StartTime: start.Add(30 * time.Second)},
+	}
+
+	var queryCount float64
+	var restarts int
+	for _, metric := range processStats(previous, current) {
+		if metric.Name == "QueryCount" && metric.Dimensions[0].Value == "test_1" {
+			queryCount = metric.Value
+		}
+		if metric.Name == "Restarts" {
+			restarts++
+		}
+	}
+	assert.InDelta(t, 700.0/60, queryCount, 0.001)
+	assert.Equal(t, 2, restarts)
+
+	// The same process keeps the regular deltas
+	current.process = previous.process
+	deltas, reset := statsDelta(previous, current)
+	assert.False(t, reset)
+	assert.InDelta(t, 10, deltas["test_1"].QueryCount, 0.001)
+}
+
+func TestGetDataCollectPools(t *testing.T) {
+	defer func(old instanceMetadata) { metadata = old }(metadata)
+	metadata = instanceMetadata{collectPools: true}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SHOW STATS_TOTALS").WillReturnRows(sqlmock.NewRows([]string{"database", "query_count"}))
+	mock.ExpectQuery("SHOW CONFIG").WillReturnRows(sqlmock.NewRows([]string{"key", "value"}))
+	mock.ExpectQuery("SHOW LISTS").WillReturnRows(sqlmock.NewRows([]string{"list", "items"}))
+	mock.ExpectQuery("SHOW POOLS").WillReturnRows(sqlmock.NewRows([]string{"database", "user", "cl_waiting"}).
+		AddRow("test_1", "app", 2))
+	mock.ExpectQuery("SHOW DATABASES").WillReturnRows(sqlmock.NewRows([]string{"name", "pool_size"}))
+
+	point, err := getData(context.Background(), sqlx.NewDb(db, "sqlmock"), statsTotalsVersion)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, float64(2), point.pools[poolKey{"test_1", "app"}].ClientsWaiting)
+
+	// The pool metrics are only published to the other sinks when detailed
+	for _, metric := range processStats(*point, *point) {
+		assert.NotEqual(t, "ClientsWaiting", metric.Name)
+	}
 }
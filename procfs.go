@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// procRoot is the mount point of procfs, changed by the tests.
+var procRoot = "/proc"
+
+// clockTicks is the number of clock ticks per second used by /proc, this
+// is USER_HZ which is 100 on all supported Linux architectures.
+const clockTicks = 100
+
+// Process holds the resource usage of the pgbouncer process.
+type Process struct {
+	Pid          int
+	CPUSeconds   float64
+	RSS          float64
+	OpenFiles    float64
+	MaxOpenFiles float64
+	Threads      float64
+	StartTime    time.Time
+	TimeStamp    time.Time
+}
+
+func (p *Process) addMetricData(dest []Metric, previous *Process) []Metric {
+	instance := Dimension{Name: "InstanceId", Value: metadata.InstanceID}
+	dest = append(dest,
+		newMetric("ProcessResidentMemory", p.RSS, UnitBytes, p.TimeStamp, instance),
+		newMetric("ProcessOpenFiles", p.OpenFiles, UnitCount, p.TimeStamp, instance),
+		newMetric("ProcessThreads", p.Threads, UnitCount, p.TimeStamp, instance),
+		newMetric("ProcessUptime", p.TimeStamp.Sub(p.StartTime).Seconds(), UnitSeconds, p.TimeStamp, instance))
+
+	if p.MaxOpenFiles > 0 {
+		dest = append(dest, newMetric(
+			"ProcessOpenFilesUtilization", p.OpenFiles*100/p.MaxOpenFiles, UnitPercent, p.TimeStamp, instance))
+	}
+
+	// pgbouncer is single threaded, so 100% means a single core is saturated
+	if previous != nil && previous.Pid == p.Pid && p.TimeStamp.After(previous.TimeStamp) {
+		elapsed := p.TimeStamp.Sub(previous.TimeStamp).Seconds()
+		cpu := (p.CPUSeconds - previous.CPUSeconds) / elapsed * 100
+		dest = append(dest, newMetric("ProcessCPUUtilization", cpu, UnitPercent, p.TimeStamp, instance))
+	}
+	return dest
+}
+
+// isRestarted returns true if the process was restarted since previous.
+func (p *Process) isRestarted(previous *Process) bool {
+	return previous != nil && (p.Pid != previous.Pid || !p.StartTime.Equal(previous.StartTime))
+}
+
+// findPid returns the pid from the pidfile, or when no pidfile is known
+// the pid of the only process named pgbouncer.
+func findPid(pidfile string) (int, error) {
+	if pidfile != "" {
+		data, err := ioutil.ReadFile(pidfile)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return 0, err
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := ioutil.ReadFile(filepath.Join(procRoot, entry.Name(), "comm"))
+		if err == nil && strings.TrimSpace(string(comm)) == "pgbouncer" {
+			pids = append(pids, pid)
+		}
+	}
+	if len(pids) != 1 {
+		return 0, fmt.Errorf("found %d pgbouncer processes, configure a pidfile", len(pids))
+	}
+	return pids[0], nil
+}
+
+// readProcStat parses /proc/<pid>/stat.
+func readProcStat(p *Process, bootTime time.Time) error {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(p.Pid), "stat"))
+	if err != nil {
+		return err
+	}
+
+	// The command name may contain spaces, so skip past it.
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return fmt.Errorf("unexpected format of /proc/%d/stat", p.Pid)
+	}
+
+	utime, _ := strconv.ParseFloat(fields[11], 64)
+	stime, _ := strconv.ParseFloat(fields[12], 64)
+	p.CPUSeconds = (utime + stime) / clockTicks
+	p.Threads, _ = strconv.ParseFloat(fields[17], 64)
+
+	startTicks, _ := strconv.ParseFloat(fields[19], 64)
+	p.StartTime = bootTime.Add(time.Duration(startTicks / clockTicks * float64(time.Second)))
+	return nil
+}
+
+// readProcStatus reads the resident memory from /proc/<pid>/status.
+func readProcStatus(p *Process) error {
+	file, err := os.Open(filepath.Join(procRoot, strconv.Itoa(p.Pid), "status"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kb, _ := strconv.ParseFloat(fields[1], 64)
+			p.RSS = kb * 1024
+		}
+	}
+	return scanner.Err()
+}
+
+// readProcLimits reads the soft limit of open files from /proc/<pid>/limits.
+func readProcLimits(p *Process) error {
+	file, err := os.Open(filepath.Join(procRoot, strconv.Itoa(p.Pid), "limits"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	const prefix = "Max open files"
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		fields := strings.Fields(line[len(prefix):])
+		if len(fields) > 0 {
+			// unlimited results in 0, which disables the utilization
+			p.MaxOpenFiles, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+	return scanner.Err()
+}
+
+// readBootTime reads the system boot time from /proc/stat.
+func readBootTime() (time.Time, error) {
+	file, err := os.Open(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "btime" {
+			seconds, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, fmt.Errorf("btime not found in %s/stat", procRoot)
+}
+
+// getProcessData samples the pgbouncer process. The pidfile from the flags
+// takes precedence over the one in the pgbouncer config.
+func getProcessData(config PGBouncerConfig) (*Process, error) {
+	pidfile := metadata.pidfile
+	if pidfile == "" {
+		pidfile = config["pidfile"]
+	}
+	pid, err := findPid(pidfile)
+	if err != nil {
+		return nil, err
+	}
+
+	bootTime, err := readBootTime()
+	if err != nil {
+		return nil, err
+	}
+
+	process := Process{Pid: pid, TimeStamp: time.Now()}
+	if err := readProcStat(&process, bootTime); err != nil {
+		return nil, err
+	}
+	if err := readProcStatus(&process); err != nil {
+		return nil, err
+	}
+	if err := readProcLimits(&process); err != nil {
+		return nil, err
+	}
+
+	fds, err := ioutil.ReadDir(filepath.Join(procRoot, strconv.Itoa(pid), "fd"))
+	if err != nil {
+		return nil, err
+	}
+	process.OpenFiles = float64(len(fds))
+	return &process, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFakeProc(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetProcessData(t *testing.T) {
+	root, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFakeProc(t, root, map[string]string{
+		"stat":          "cpu  1 2 3 4\nbtime 1500000000\n",
+		"1/comm":        "init\n",
+		"42/comm":       "pgbouncer\n",
+		"42/stat":       "42 (pg bouncer) S 1 42 42 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 1 0 12000 20000000 1000 18446744073709551615\n",
+		"42/status":     "Name:\tpgbouncer\nVmRSS:\t    4096 kB\nThreads:\t1\n",
+		"42/limits":     "Limit                     Soft Limit           Hard Limit           Units\nMax open files            1024                 4096                 files\n",
+		"42/fd/0":       "",
+		"42/fd/1":       "",
+		"42/fd/2":       "",
+		"42/fd/3":       "",
+		"pgbouncer.pid": "42\n",
+	})
+
+	defer func(old string) { procRoot = old }(procRoot)
+	procRoot = root
+
+	process, err := getProcessData(PGBouncerConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, 42, process.Pid)
+	assert.Equal(t, float64(3), process.CPUSeconds)
+	assert.Equal(t, float64(4096*1024), process.RSS)
+	assert.Equal(t, float64(4), process.OpenFiles)
+	assert.Equal(t, float64(1024), process.MaxOpenFiles)
+	assert.Equal(t, float64(1), process.Threads)
+	assert.Equal(t, time.Unix(1500000120, 0), process.StartTime)
+
+	fromPidfile, err := getProcessData(PGBouncerConfig{"pidfile": filepath.Join(root, "pgbouncer.pid")})
+	assert.Nil(t, err)
+	assert.Equal(t, 42, fromPidfile.Pid)
+
+	previous := *process
+	previous.CPUSeconds = 2.5
+	previous.TimeStamp = process.TimeStamp.Add(-10 * time.Second)
+	assert.False(t, process.isRestarted(&previous))
+
+	var cpu, utilization float64
+	for _, metric := range process.addMetricData(nil, &previous) {
+		switch metric.Name {
+		case "ProcessCPUUtilization":
+			cpu = metric.Value
+		case "ProcessOpenFilesUtilization":
+			utilization = metric.Value
+		}
+	}
+	assert.InDelta(t, 5, cpu, 0.001)
+	assert.InDelta(t, 0.390625, utilization, 0.0001)
+
+	previous.StartTime = previous.StartTime.Add(-time.Hour)
+	assert.True(t, process.isRestarted(&previous))
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The scrapes only read the latest snapshots, slow clients shouldn't hold
+// on to a connection.
+const (
+	prometheusReadHeaderTimeout = 5 * time.Second
+	prometheusWriteTimeout      = 10 * time.Second
+)
+
+// prometheusSink exposes the most recently collected data on an HTTP
+// endpoint in the Prometheus text exposition format. Unlike the other sinks
+// it works on the raw snapshots so the STATS_TOTALS counters are exported as
+// real counters instead of per-second rates.
+type prometheusSink struct {
+	mu        sync.RWMutex
+	snapshots map[string]prometheusSnapshot
+}
+
+type prometheusSnapshot struct {
+	labels []Dimension
+	point  *statusPoint
+}
+
+type prometheusFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []prometheusSample
+}
+
+type prometheusSample struct {
+	labels []Dimension
+	value  float64
+}
+
+func newPrometheusSink(cfg sinkConfig) (Sink, error) {
+	listener, err := net.Listen("tcp", cfg.prometheusListen)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := newPrometheusHandler()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", sink)
+
+	log.Printf("Serving Prometheus metrics on %s/metrics\n", listener.Addr())
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: prometheusReadHeaderTimeout,
+		WriteTimeout:      prometheusWriteTimeout,
+	}
+	go func() {
+		log.Println(server.Serve(listener))
+	}()
+	return sink, nil
+}
+
+func newPrometheusHandler() *prometheusSink {
+	return &prometheusSink{snapshots: make(map[string]prometheusSnapshot)}
+}
+
+func (p *prometheusSink) Name() string {
+	return "prometheus"
+}
+
+// Push is a no-op, the data is scraped through Observe instead.
+func (p *prometheusSink) Push(metrics []Metric) error {
+	return nil
+}
+
+func (p *prometheusSink) Observe(t *target, point *statusPoint) {
+	labels := targetLabels(t)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.snapshots[t.Name] = prometheusSnapshot{labels: labels, point: point}
+}
+
+func (p *prometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	names := make([]string, 0, len(p.snapshots))
+	for name := range p.snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var families []prometheusFamily
+	for _, name := range names {
+		snapshot := p.snapshots[name]
+		families = mergePrometheusFamilies(families, prometheusFamilies(snapshot.labels, snapshot.point))
+	}
+	p.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writePrometheusFamilies(w, families)
+}
+
+// reservedLabels are the labels used by the families, the dimensions of a
+// target may not clash with them.
+var reservedLabels = []string{
+	"target", "database", "user", "pool_mode", "state", "cache", "task",
+	"application_name", "client_subnet",
+}
+
+// prometheusLabelName converts a dimension name into a valid label name,
+// [a-zA-Z_][a-zA-Z0-9_]* in lower case.
+func prometheusLabelName(name string) string {
+	result := []byte(strings.ToLower(name))
+	for i, c := range result {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			result[i] = '_'
+		}
+	}
+	if len(result) > 0 && result[0] >= '0' && result[0] <= '9' {
+		return "_" + string(result)
+	}
+	return string(result)
+}
+
+// targetLabels returns the dimensions of the target as labels.
+func targetLabels(t *target) []Dimension {
+	var labels []Dimension
+	for _, dimension := range t.dimensions() {
+		labels = append(labels, Dimension{Name: prometheusLabelName(dimension.Name), Value: dimension.Value})
+	}
+	return labels
+}
+
+func prometheusFamilies(labels []Dimension, point *statusPoint) []prometheusFamily {
+	const upHelp = "Whether the last scrape of pgbouncer was successful."
+	if point == nil {
+		return []prometheusFamily{prometheusGauge("pgbouncer_up", upHelp, labels, 0)}
+	}
+
+	families := []prometheusFamily{prometheusGauge("pgbouncer_up", upHelp, labels, 1)}
+	families = append(families, prometheusStatsFamilies(labels, point.stats)...)
+	families = append(families, prometheusPoolFamilies(labels, point.pools)...)
+	families = append(families, prometheusListsFamilies(labels, point.lists)...)
+	families = append(families, prometheusDatabaseFamilies(labels, point.databases)...)
+	families = append(families, prometheusClientFamilies(labels, point.clients)...)
+	families = append(families, prometheusServerFamilies(labels, point.servers)...)
+	families = append(families, prometheusInternalsFamilies(labels, point.internals)...)
+	families = append(families, prometheusProcessFamilies(labels, point.process)...)
+	if len(point.config) > 0 {
+		families = append(families, prometheusGauge("pgbouncer_config_fingerprint",
+			"Hash of all settings reported by SHOW CONFIG.", labels, point.config.fingerprint()))
+	}
+	return families
+}
+
+// mergePrometheusFamilies adds the samples of the families in other to the
+// families with the same name in dest.
+func mergePrometheusFamilies(dest []prometheusFamily, other []prometheusFamily) []prometheusFamily {
+	for _, family := range other {
+		found := false
+		for i := range dest {
+			if dest[i].name == family.name {
+				dest[i].samples = append(dest[i].samples, family.samples...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			dest = append(dest, family)
+		}
+	}
+	return dest
+}
+
+func prometheusStatsFamilies(base []Dimension, stats DBStats) []prometheusFamily {
+	families := []prometheusFamily{
+		{name: "pgbouncer_stats_queries_total", help: "Total number of SQL queries pooled."},
+		{name: "pgbouncer_stats_queries_duration_seconds_total", help: "Total time spent by pgbouncer actively querying PostgreSQL."},
+		{name: "pgbouncer_stats_client_wait_seconds_total", help: "Total time spent by clients waiting for a server."},
+		{name: "pgbouncer_stats_transactions_total", help: "Total number of SQL transactions pooled."},
+		{name: "pgbouncer_stats_transactions_duration_seconds_total", help: "Total time spent by pgbouncer in a transaction."},
+		{name: "pgbouncer_stats_received_bytes_total", help: "Total volume in bytes of network traffic received."},
+		{name: "pgbouncer_stats_sent_bytes_total", help: "Total volume in bytes of network traffic sent."},
+	}
+
+	for _, key := range sortedStatsKeys(stats) {
+		s := stats[key]
+		if s.IsAggregated {
+			continue
+		}
+		labels := withLabels(base, Dimension{Name: "database", Value: s.Database})
+		values := []float64{
+			s.QueryCount,
+			s.QueryTime / 1000000,
+			s.WaitTime / 1000000,
+			s.TransactionCount,
+			s.TransactionTime / 1000000,
+			s.BytesReceived,
+			s.BytesSent,
+		}
+		for i, value := range values {
+			families[i].samples = append(families[i].samples, prometheusSample{labels, value})
+		}
+		if s.HasPreparedStatements {
+			families = mergePrometheusFamilies(families, []prometheusFamily{
+				{name: "pgbouncer_stats_server_assignments_total", help: "Total number of times a server was assigned to a client.",
+					samples: []prometheusSample{{labels, s.ServerAssignmentCount}}},
+				{name: "pgbouncer_stats_client_parses_total", help: "Total number of prepared statements created by clients.",
+					samples: []prometheusSample{{labels, s.ClientParseCount}}},
+				{name: "pgbouncer_stats_server_parses_total", help: "Total number of prepared statements created on a server.",
+					samples: []prometheusSample{{labels, s.ServerParseCount}}},
+				{name: "pgbouncer_stats_binds_total", help: "Total number of prepared statements readied for execution.",
+					samples: []prometheusSample{{labels, s.BindCount}}},
+			})
+		}
+		families = addPrometheusExtra(families, "pgbouncer_stats_", "_total", labels, s.Extra)
+	}
+
+	for i := range families {
+		families[i].kind = "counter"
+	}
+	return families
+}
+
+func prometheusPoolFamilies(base []Dimension, pools DBPools) []prometheusFamily {
+	families := []prometheusFamily{
+		{name: "pgbouncer_pools_client_active_connections", help: "Client connections linked to a server connection and able to process queries."},
+		{name: "pgbouncer_pools_client_waiting_connections", help: "Client connections waiting on a server connection."},
+		{name: "pgbouncer_pools_server_active_connections", help: "Server connections linked to a client connection."},
+		{name: "pgbouncer_pools_server_idle_connections", help: "Server connections idle and ready for a client query."},
+		{name: "pgbouncer_pools_server_used_connections", help: "Server connections idle more than server_check_delay."},
+		{name: "pgbouncer_pools_server_testing_connections", help: "Server connections currently running server_reset_query or server_check_query."},
+		{name: "pgbouncer_pools_server_login_connections", help: "Server connections currently in the process of logging in."},
+		{name: "pgbouncer_pools_client_maxwait_seconds", help: "Age of the oldest unserved client connection."},
+	}
+
+	for _, key := range sortedPoolKeys(pools) {
+		p := pools[key]
+		if p.IsAggregated {
+			continue
+		}
+		labels := withLabels(base,
+			Dimension{Name: "database", Value: p.Database},
+			Dimension{Name: "user", Value: p.User},
+			Dimension{Name: "pool_mode", Value: p.PoolMode})
+		values := []float64{
+			p.ClientsActive,
+			p.ClientsWaiting,
+			p.ServersActive,
+			p.ServersIdle,
+			p.ServersUsed,
+			p.ServersTested,
+			p.ServersLogin,
+			p.maxWaitSeconds(),
+		}
+		for i, value := range values {
+			families[i].samples = append(families[i].samples, prometheusSample{labels, value})
+		}
+		families = addPrometheusExtra(families, "pgbouncer_pools_", "", labels, p.Extra)
+	}
+
+	for i := range families {
+		families[i].kind = "gauge"
+	}
+	return families
+}
+
+func prometheusDatabaseFamilies(base []Dimension, databases DBDatabases) []prometheusFamily {
+	families := []prometheusFamily{
+		{name: "pgbouncer_databases_pool_size", help: "Maximum number of server connections per pool."},
+		{name: "pgbouncer_databases_reserve_pool", help: "Maximum number of additional server connections per pool."},
+		{name: "pgbouncer_databases_current_connections", help: "Current number of server connections for the database."},
+		{name: "pgbouncer_databases_paused", help: "Whether the database is paused."},
+		{name: "pgbouncer_databases_disabled", help: "Whether the database is disabled."},
+	}
+
+	names := make([]string, 0, len(databases))
+	for name := range databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		d := databases[name]
+		labels := withLabels(base, Dimension{Name: "database", Value: d.Name})
+		values := []float64{d.PoolSize, d.ReservePool, d.CurrentConnections, d.Paused, d.Disabled}
+		for i, value := range values {
+			families[i].samples = append(families[i].samples, prometheusSample{labels, value})
+		}
+	}
+
+	for i := range families {
+		families[i].kind = "gauge"
+	}
+	return families
+}
+
+func prometheusClientFamilies(base []Dimension, groups []ClientGroup) []prometheusFamily {
+	families := []prometheusFamily{
+		{name: "pgbouncer_clients_connections", help: "Number of client connections per group."},
+		{name: "pgbouncer_clients_waiting_connections", help: "Number of waiting client connections per group."},
+		{name: "pgbouncer_clients_oldest_wait_seconds", help: "Age of the oldest waiting client connection per group."},
+	}
+
+	for _, g := range groups {
+		labels := withLabels(base,
+			Dimension{Name: "application_name", Value: g.ApplicationName},
+			Dimension{Name: "user", Value: g.User},
+			Dimension{Name: "client_subnet", Value: g.Subnet})
+		values := []float64{g.Connections, g.Waiting, g.OldestWait}
+		for i, value := range values {
+			families[i].samples = append(families[i].samples, prometheusSample{labels, value})
+		}
+	}
+
+	for i := range families {
+		families[i].kind = "gauge"
+	}
+	return families
+}
+
+func prometheusServerFamilies(base []Dimension, servers DBServers) []prometheusFamily {
+	connections := prometheusFamily{
+		name: "pgbouncer_servers_connections",
+		help: "Number of server connections per state.",
+		kind: "gauge",
+	}
+	maxAge := prometheusFamily{
+		name: "pgbouncer_servers_max_age_seconds",
+		help: "Age of the oldest server connection.",
+		kind: "gauge",
+	}
+
+	keys := make([]poolKey, 0, len(servers))
+	for key := range servers {
+		keys = append(keys, key)
+	}
+	sortPoolKeys(keys)
+
+	for _, key := range keys {
+		g := servers[key]
+		labels := withLabels(base,
+			Dimension{Name: "database", Value: g.Database},
+			Dimension{Name: "user", Value: g.User})
+		for _, state := range serverStates {
+			connections.samples = append(connections.samples, prometheusSample{
+				withLabels(labels, Dimension{Name: "state", Value: state}), g.States[state]})
+		}
+		maxAge.samples = append(maxAge.samples, prometheusSample{labels, g.MaxAge})
+	}
+	return []prometheusFamily{connections, maxAge}
+}
+
+func prometheusInternalsFamilies(base []Dimension, internals *Internals) []prometheusFamily {
+	if internals == nil {
+		return nil
+	}
+
+	families := []prometheusFamily{
+		{name: "pgbouncer_mem_used_items", help: "Number of used items in the memory cache.", kind: "gauge"},
+		{name: "pgbouncer_mem_free_items", help: "Number of free items in the memory cache.", kind: "gauge"},
+		{name: "pgbouncer_mem_total_bytes", help: "Total memory used by the memory cache.", kind: "gauge"},
+		{name: "pgbouncer_mem_item_size_bytes", help: "Size of a single item of the memory cache.", kind: "gauge"},
+		{name: "pgbouncer_fds", help: "Number of file descriptors per task.", kind: "gauge"},
+	}
+	for _, cache := range internals.Caches {
+		labels := withLabels(base, Dimension{Name: "cache", Value: cache.Name})
+		values := []float64{cache.Used, cache.Free, cache.MemTotal, cache.Size}
+		for i, value := range values {
+			families[i].samples = append(families[i].samples, prometheusSample{labels, value})
+		}
+	}
+	for _, task := range sortedExtraKeys(internals.FileDescriptors) {
+		labels := withLabels(base, Dimension{Name: "task", Value: task})
+		families[4].samples = append(families[4].samples, prometheusSample{labels, internals.FileDescriptors[task]})
+	}
+	return families
+}
+
+func prometheusProcessFamilies(labels []Dimension, process *Process) []prometheusFamily {
+	if process == nil {
+		return nil
+	}
+
+	cpu := prometheusGauge("pgbouncer_process_cpu_seconds_total", "Total user and system CPU time spent in seconds.", labels, process.CPUSeconds)
+	cpu.kind = "counter"
+	return []prometheusFamily{
+		cpu,
+		prometheusGauge("pgbouncer_process_resident_memory_bytes", "Resident memory size in bytes.", labels, process.RSS),
+		prometheusGauge("pgbouncer_process_open_fds", "Number of open file descriptors.", labels, process.OpenFiles),
+		prometheusGauge("pgbouncer_process_max_fds", "Soft limit of open file descriptors.", labels, process.MaxOpenFiles),
+		prometheusGauge("pgbouncer_process_threads", "Number of threads.", labels, process.Threads),
+		prometheusGauge("pgbouncer_process_start_time_seconds", "Start time of the process since the unix epoch in seconds.", labels, float64(process.StartTime.Unix())),
+	}
+}
+
+func prometheusListsFamilies(labels []Dimension, lists *Lists) []prometheusFamily {
+	if lists == nil {
+		return nil
+	}
+
+	return []prometheusFamily{
+		prometheusGauge("pgbouncer_lists_used_clients", "Number of client connections in use.", labels, lists.UsedClients),
+		prometheusGauge("pgbouncer_lists_free_clients", "Number of free client connection slots.", labels, lists.FreeClients),
+		prometheusGauge("pgbouncer_lists_login_clients", "Number of clients in the login state.", labels, lists.LoginClients),
+		prometheusGauge("pgbouncer_lists_used_servers", "Number of server connections in use.", labels, lists.UsedServers),
+		prometheusGauge("pgbouncer_lists_free_servers", "Number of free server connection slots.", labels, lists.FreeServers),
+		prometheusGauge("pgbouncer_lists_pools", "Number of pools.", labels, lists.Pools),
+		prometheusGauge("pgbouncer_config_max_client_connections", "Configured max_client_conn.", labels, lists.MaxClientConn),
+	}
+}
+
+// addPrometheusExtra adds the values of the extra columns to the families,
+// named after the column.
+func addPrometheusExtra(families []prometheusFamily, prefix, suffix string, labels []Dimension, extra map[string]float64) []prometheusFamily {
+	for _, column := range sortedExtraKeys(extra) {
+		name := prefix + strings.TrimSuffix(column, suffix) + suffix
+		families = mergePrometheusFamilies(families, []prometheusFamily{{
+			name:    name,
+			help:    fmt.Sprintf("Value of the %s column.", column),
+			samples: []prometheusSample{{labels, extra[column]}},
+		}})
+	}
+	return families
+}
+
+// prometheusGauge returns a family with a single gauge sample.
+func prometheusGauge(name string, help string, labels []Dimension, value float64) prometheusFamily {
+	return prometheusFamily{
+		name:    name,
+		help:    help,
+		kind:    "gauge",
+		samples: []prometheusSample{{labels: labels, value: value}},
+	}
+}
+
+// withLabels returns a new slice with the labels appended to base.
+func withLabels(base []Dimension, labels ...Dimension) []Dimension {
+	result := make([]Dimension, 0, len(base)+len(labels))
+	result = append(result, base...)
+	return append(result, labels...)
+}
+
+func writePrometheusFamilies(w io.Writer, families []prometheusFamily) {
+	for _, family := range families {
+		if len(family.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.kind)
+		for _, sample := range family.samples {
+			fmt.Fprintf(w, "%s%s %v\n", family.name, formatPrometheusLabels(sample.labels), sample.value)
+		}
+	}
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatPrometheusLabels(labels []Dimension) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = fmt.Sprintf(`%s="%s"`, label.Name, prometheusLabelEscaper.Replace(label.Value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func sortedStatsKeys(stats DBStats) []string {
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedPoolKeys(pools DBPools) []poolKey {
+	keys := make([]poolKey, 0, len(pools))
+	for key := range pools {
+		keys = append(keys, key)
+	}
+	sortPoolKeys(keys)
+	return keys
+}
+
+func sortPoolKeys(keys []poolKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Database != keys[j].Database {
+			return keys[i].Database < keys[j].Database
+		}
+		return keys[i].User < keys[j].User
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusSinkServeHTTP(t *testing.T) {
+	sink := newPrometheusHandler()
+	sink.Observe(&target{}, &statusPoint{
+		stats: DBStats{
+			"test_1": Stats{
+				Database:         "test_1",
+				QueryCount:       100,
+				QueryTime:        1500000,
+				WaitTime:         250000,
+				TransactionCount: 10,
+				TransactionTime:  2000000,
+				BytesReceived:    256,
+				BytesSent:        512,
+			},
+			"": Stats{IsAggregated: true, QueryCount: 100},
+		},
+		pools: DBPools{
+			poolKey{"test_1", "client_1"}: Pool{
+				Database:       "test_1",
+				User:           "client_1",
+				ClientsWaiting: 4,
+				MaxWait:        2,
+				MaxWaitUs:      500000,
+				PoolMode:       "transaction",
+			},
+		},
+	})
+
+	recorder := httptest.NewRecorder()
+	sink.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	assert.Contains(t, body, "pgbouncer_up 1\n")
+	assert.Contains(t, body, "# TYPE pgbouncer_stats_queries_total counter\n")
+	assert.Contains(t, body, `pgbouncer_stats_queries_total{database="test_1"} 100`+"\n")
+	assert.Contains(t, body, `pgbouncer_stats_queries_duration_seconds_total{database="test_1"} 1.5`+"\n")
+	assert.Contains(t, body, "# TYPE pgbouncer_pools_client_waiting_connections gauge\n")
+	assert.Contains(t, body,
+		`pgbouncer_pools_client_waiting_connections{database="test_1",user="client_1",pool_mode="transaction"} 4`+"\n")
+	assert.Contains(t, body,
+		`pgbouncer_pools_client_maxwait_seconds{database="test_1",user="client_1",pool_mode="transaction"} 2.5`+"\n")
+	assert.Equal(t, 1, strings.Count(body, "pgbouncer_stats_queries_total{"))
+}
+
+func TestPrometheusSinkServeHTTPDown(t *testing.T) {
+	sink := newPrometheusHandler()
+	sink.Observe(&target{}, nil)
+
+	recorder := httptest.NewRecorder()
+	sink.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, "# HELP pgbouncer_up Whether the last scrape of pgbouncer was successful.\n"+
+		"# TYPE pgbouncer_up gauge\n"+
+		"pgbouncer_up 0\n", recorder.Body.String())
+}
+
+func TestPrometheusSinkServeHTTPTargets(t *testing.T) {
+	sink := newPrometheusHandler()
+	point := &statusPoint{
+		stats: DBStats{"test_1": Stats{Database: "test_1", QueryCount: 10}},
+	}
+	sink.Observe(&target{Name: "b", Dimensions: []Dimension{{"Tenant", "b"}}}, point)
+	sink.Observe(&target{Name: "a"}, nil)
+
+	recorder := httptest.NewRecorder()
+	sink.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	assert.Contains(t, body, "# TYPE pgbouncer_up gauge\n"+
+		`pgbouncer_up{target="a"} 0`+"\n"+
+		`pgbouncer_up{target="b",tenant="b"} 1`+"\n")
+	assert.Contains(t, body, `pgbouncer_stats_queries_total{target="b",tenant="b",database="test_1"} 10`+"\n")
+	assert.Equal(t, 1, strings.Count(body, "# TYPE pgbouncer_up gauge"))
+}
+
+func TestFormatPrometheusLabels(t *testing.T) {
+	labels := []Dimension{{Name: "database", Value: "a\"b\\c\nd"}}
+	assert.Equal(t, `{database="a\"b\\c\nd"}`, formatPrometheusLabels(labels))
+	assert.Equal(t, "", formatPrometheusLabels(nil))
+}
+
+func TestPrometheusExtraColumns(t *testing.T) {
+	point := &statusPoint{
+		stats: DBStats{
+			"test_1": Stats{Database: "test_1", Extra: map[string]float64{"bind_count": 5}},
+			"test_2": Stats{Database: "test_2", Extra: map[string]float64{"bind_count": 7}},
+		},
+		pools: DBPools{
+			poolKey{"test_1", "app"}: Pool{Database: "test_1", User: "app", Extra: map[string]float64{"cl_active_cancel_req": 1}},
+		},
+	}
+
+	var buf strings.Builder
+	writePrometheusFamilies(&buf, prometheusFamilies(nil, point))
+	body := buf.String()
+
+	assert.Contains(t, body, "# TYPE pgbouncer_stats_bind_count_total counter\n"+
+		`pgbouncer_stats_bind_count_total{database="test_1"} 5`+"\n"+
+		`pgbouncer_stats_bind_count_total{database="test_2"} 7`+"\n")
+	assert.Contains(t, body, "# TYPE pgbouncer_pools_cl_active_cancel_req gauge\n")
+}
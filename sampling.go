@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricSamples holds the statistics of the gauges sampled between two
+// scrapes, by metricKey.
+type metricSamples map[string]*StatisticSet
+
+// metricKey identifies a metric by its name and dimensions.
+func metricKey(metric Metric) string {
+	parts := make([]string, 0, len(metric.Dimensions)+1)
+	parts = append(parts, metric.Name)
+	for _, dimension := range metric.Dimensions {
+		parts = append(parts, dimension.Name+"="+dimension.Value)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func (s metricSamples) add(metrics []Metric) {
+	for _, metric := range metrics {
+		key := metricKey(metric)
+		set, ok := s[key]
+		if !ok {
+			set = &StatisticSet{}
+			s[key] = set
+		}
+		set.add(metric.Value)
+	}
+}
+
+// apply sets the statistics of the sampled metrics, including the value of
+// the metric itself as the last sample.
+func (s metricSamples) apply(metrics []Metric) []Metric {
+	if len(s) == 0 {
+		return metrics
+	}
+	for i, metric := range metrics {
+		set, ok := s[metricKey(metric)]
+		if !ok {
+			continue
+		}
+		statistics := *set
+		statistics.add(metric.Value)
+		metrics[i].Statistics = &statistics
+	}
+	return metrics
+}
+
+// sample adds the current pool gauges to the samples of the target.
+func (t *target) sample(ctx context.Context) error {
+	db, err := t.connection(ctx)
+	if err != nil {
+		return err
+	}
+
+	pools, err := getPoolData(ctx, db)
+	if err != nil {
+		t.disconnect()
+		return err
+	}
+
+	if t.samples == nil {
+		t.samples = make(metricSamples)
+	}
+	t.samples.add(pools.addMetricData(nil))
+	return nil
+}
+
+// sampleTargets samples the pools of all targets concurrently. Targets which
+// are still busy with a scrape or a previous sample are skipped.
+func sampleTargets(targets []*target) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadata.sampleInterval)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		if !t.tryAcquire() {
+			continue
+		}
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			defer t.release()
+			if err := t.sample(ctx); err != nil {
+				t.logf("Error sampling pools: %v", err)
+			}
+		}(t)
+	}
+	wg.Wait()
+}
+
+// sampleUntil samples the targets every sample interval until the deadline,
+// it only sleeps when sampling is disabled.
+func sampleUntil(targets []*target, deadline time.Time) {
+	if metadata.sampleInterval <= 0 {
+		time.Sleep(time.Until(deadline))
+		return
+	}
+	for {
+		next := time.Now().Add(metadata.sampleInterval)
+		if !next.Before(deadline) {
+			time.Sleep(time.Until(deadline))
+			return
+		}
+		time.Sleep(time.Until(next))
+		sampleTargets(targets)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricSamples(t *testing.T) {
+	timestamp := time.Now()
+	database := Dimension{Name: "Database", Value: "test_1"}
+	sampled := func(value float64) []Metric {
+		return []Metric{newMetric("ClientsWaiting", value, UnitCount, timestamp, database)}
+	}
+
+	samples := make(metricSamples)
+	samples.add(sampled(4))
+	samples.add(sampled(12))
+	samples.add(sampled(0))
+
+	metrics := samples.apply([]Metric{
+		newMetric("ClientsWaiting", 2, UnitCount, timestamp, database),
+		newMetric("ClientsWaiting", 1, UnitCount, timestamp, Dimension{Name: "Database", Value: "test_2"}),
+	})
+	assert.Equal(t, &StatisticSet{Minimum: 0, Maximum: 12, Sum: 18, SampleCount: 4}, metrics[0].Statistics)
+	assert.Equal(t, float64(2), metrics[0].Value)
+	assert.Nil(t, metrics[1].Statistics)
+
+	// Applying does not change the samples
+	assert.Equal(t, &StatisticSet{Minimum: 0, Maximum: 12, Sum: 16, SampleCount: 3}, samples[metricKey(sampled(0)[0])])
+
+	var empty metricSamples
+	assert.Nil(t, empty.apply(sampled(1))[0].Statistics)
+}
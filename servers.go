@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// connectTimeLayout is the format of the connect_time column, pgbouncer
+// formats it in its local time zone with the zone abbreviation.
+const (
+	connectTimeLayout     = "2006-01-02 15:04:05 MST"
+	connectTimeZoneLayout = "2006-01-02 15:04:05"
+)
+
+// defaultServerLifetime is used when server_lifetime is not configured.
+const defaultServerLifetime = 3600
+
+// serverStates are the published states, login matches sv_login of SHOW
+// POOLS. The cancel states are reported since pgbouncer 1.18.
+var serverStates = []string{"active", "idle", "used", "tested", "login", "active_cancel", "being_canceled"}
+
+// serverStateNames maps the states of SHOW SERVERS to the published name,
+// a server connection logging in is reported as new.
+var serverStateNames = map[string]string{"new": "login"}
+
+// serverAgeBuckets are the upper bounds of the age buckets, as a fraction
+// of server_lifetime.
+var serverAgeBuckets = []struct {
+	name  string
+	upper float64
+}{
+	{"0-25%", 0.25},
+	{"25-50%", 0.5},
+	{"50-75%", 0.75},
+	{"75-100%", 1},
+	{"over-100%", math.Inf(1)},
+}
+
+type Server struct {
+	User        string `db:"user"`
+	Database    string `db:"database"`
+	State       string `db:"state"`
+	Ptr         string `db:"ptr"`
+	ConnectTime string `db:"connect_time"`
+	// The number of cached prepared statements, since pgbouncer 1.21
+	PreparedStatements float64 `db:"prepared_statements"`
+}
+
+// ServerGroup holds the server connections of a single pool.
+type ServerGroup struct {
+	Database   string
+	User       string
+	States     map[string]float64
+	AgeBuckets []float64
+	MaxAge     float64
+	// The number of prepared statements cached on the server connections
+	PreparedStatements float64
+	TimeStamp          time.Time
+
+	// The identifiers of the connections, used to count the connections
+	// opened and closed between two snapshots.
+	connections map[string]bool
+}
+
+type DBServers map[poolKey]*ServerGroup
+
+func newServerGroup(database, user string, timestamp time.Time) *ServerGroup {
+	return &ServerGroup{
+		Database:    database,
+		User:        user,
+		States:      make(map[string]float64),
+		AgeBuckets:  make([]float64, len(serverAgeBuckets)),
+		TimeStamp:   timestamp,
+		connections: make(map[string]bool),
+	}
+}
+
+func (g *ServerGroup) add(s Server, lifetime float64) {
+	state := s.State
+	if name, ok := serverStateNames[state]; ok {
+		state = name
+	}
+	g.States[state]++
+	g.PreparedStatements += s.PreparedStatements
+	g.connections[s.Ptr+"@"+s.ConnectTime] = true
+
+	connectTime, err := parseConnectTime(s.ConnectTime)
+	if err != nil {
+		return
+	}
+	age := math.Max(0, g.TimeStamp.Sub(connectTime).Seconds())
+	g.MaxAge = math.Max(g.MaxAge, age)
+	for i, bucket := range serverAgeBuckets {
+		if age < bucket.upper*lifetime {
+			g.AgeBuckets[i]++
+			break
+		}
+	}
+}
+
+// churn returns the number of connections opened and closed since the
+// previous snapshot of the group, which may be nil.
+func (g *ServerGroup) churn(previous *ServerGroup) (opened, closed float64) {
+	for id := range g.connections {
+		if previous == nil || !previous.connections[id] {
+			opened++
+		}
+	}
+	if previous != nil {
+		for id := range previous.connections {
+			if !g.connections[id] {
+				closed++
+			}
+		}
+	}
+	return opened, closed
+}
+
+func (g *ServerGroup) addMetricData(dest []Metric, previous *ServerGroup) []Metric {
+	dimensions := []Dimension{
+		{Name: "Database", Value: g.Database},
+		{Name: "User", Value: g.User},
+	}
+	for _, state := range serverStates {
+		dest = append(dest, newMetric(
+			"ServerConnections", g.States[state], UnitCount, g.TimeStamp,
+			dimensions[0], dimensions[1], Dimension{Name: "State", Value: state}))
+	}
+	for i, bucket := range serverAgeBuckets {
+		dest = append(dest, newMetric(
+			"ServerConnectionsByAge", g.AgeBuckets[i], UnitCount, g.TimeStamp,
+			dimensions[0], dimensions[1], Dimension{Name: "LifetimeBucket", Value: bucket.name}))
+	}
+	dest = append(dest,
+		newMetric("ServerConnectionMaxAge", g.MaxAge, UnitSeconds, g.TimeStamp, dimensions...),
+		newMetric("ServerPreparedStatements", g.PreparedStatements, UnitCount, g.TimeStamp, dimensions...))
+
+	if previous != nil {
+		opened, closed := g.churn(previous)
+		dest = append(dest,
+			newMetric("ServerConnectionsOpened", opened, UnitCount, g.TimeStamp, dimensions...),
+			newMetric("ServerConnectionsClosed", closed, UnitCount, g.TimeStamp, dimensions...))
+	}
+	return dest
+}
+
+// parseConnectTime parses connect_time in the time zone of the pgbouncer
+// host. Abbreviations unknown to that zone would be parsed with a zero
+// offset, the wall clock time is used in the zone instead.
+func parseConnectTime(value string) (time.Time, error) {
+	location := metadata.pgbouncerLocation
+	if location == nil {
+		location = time.Local
+	}
+	result, err := time.ParseInLocation(connectTimeLayout, value, location)
+	if err != nil || result.Location() == location || result.Location() == time.UTC {
+		return result, err
+	}
+	return time.ParseInLocation(connectTimeZoneLayout, value[:len(connectTimeZoneLayout)], location)
+}
+
+// addMetricData adds the metrics of all pools. Pools which disappeared
+// since the previous snapshot are reported with all connections closed, at
+// the time of the snapshot (or the previous one when no pools are left).
+func (d DBServers) addMetricData(dest []Metric, previous DBServers) []Metric {
+	var timestamp time.Time
+	for key, group := range d {
+		timestamp = group.TimeStamp
+		prev := previous[key]
+		if previous != nil && prev == nil {
+			prev = newServerGroup(group.Database, group.User, group.TimeStamp)
+		}
+		dest = group.addMetricData(dest, prev)
+	}
+	for key, prev := range previous {
+		if _, ok := d[key]; ok {
+			continue
+		}
+		closed := float64(len(prev.connections))
+		closedAt := timestamp
+		if closedAt.IsZero() {
+			closedAt = prev.TimeStamp
+		}
+		dest = append(dest, newMetric(
+			"ServerConnectionsClosed", closed, UnitCount, closedAt,
+			Dimension{Name: "Database", Value: prev.Database},
+			Dimension{Name: "User", Value: prev.User}))
+	}
+	return dest
+}
+
+func getServerData(ctx context.Context, db *sqlx.DB, config PGBouncerConfig) (DBServers, error) {
+	var servers []Server
+	err := selectContext(ctx, db.Unsafe(), &servers, `SHOW SERVERS`)
+	if err != nil {
+		return nil, err
+	}
+
+	// A server_lifetime of 0 disables it, fall back to the default for the
+	// age buckets.
+	lifetime, ok := config.float("server_lifetime")
+	if !ok || lifetime <= 0 {
+		lifetime = defaultServerLifetime
+	}
+
+	timestamp := time.Now()
+	result := make(DBServers)
+	for _, server := range servers {
+		key := poolKey{server.Database, server.User}
+		group, ok := result[key]
+		if !ok {
+			group = newServerGroup(server.Database, server.User, timestamp)
+			result[key] = group
+		}
+		group.add(server, lifetime)
+	}
+	return result, nil
+}
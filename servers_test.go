@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestGetServerData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	connectTime := func(age time.Duration) string {
+		return time.Now().UTC().Add(-age).Format(connectTimeLayout)
+	}
+	rows := sqlmock.NewRows([]string{"type", "user", "database", "state", "connect_time", "ptr"}).
+		AddRow("S", "app", "test_1", "active", connectTime(10*time.Second), "0x1").
+		AddRow("S", "app", "test_1", "idle", connectTime(70*time.Second), "0x2").
+		AddRow("S", "app", "test_1", "idle", connectTime(130*time.Second), "0x3").
+		AddRow("S", "migrate", "test_1", "new", connectTime(time.Second), "0x4").
+		AddRow("S", "migrate", "test_1", "active_cancel", connectTime(time.Second), "0x5")
+	mock.ExpectQuery("SHOW SERVERS").WillReturnRows(rows)
+
+	config := PGBouncerConfig{"server_lifetime": "120"}
+	servers, err := getServerData(context.Background(), sqlx.NewDb(db, "sqlmock"), config)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(servers))
+
+	app := servers[poolKey{"test_1", "app"}]
+	assert.Equal(t, map[string]float64{"active": 1, "idle": 2}, app.States)
+	assert.Equal(t, []float64{1, 0, 1, 0, 1}, app.AgeBuckets)
+	assert.InDelta(t, 130, app.MaxAge, 2)
+
+	migrate := servers[poolKey{"test_1", "migrate"}]
+	assert.Equal(t, map[string]float64{"login": 1, "active_cancel": 1}, migrate.States)
+}
+
+func TestParseConnectTime(t *testing.T) {
+	defer func(old *time.Location) { metadata.pgbouncerLocation = old }(metadata.pgbouncerLocation)
+	metadata.pgbouncerLocation = time.FixedZone("CET", 3600)
+	noon := time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)
+
+	connectTime, err := parseConnectTime("2024-01-01 12:00:00 CET")
+	assert.Nil(t, err)
+	assert.True(t, noon.Equal(connectTime), connectTime.String())
+
+	connectTime, err = parseConnectTime("2024-01-01 11:00:00 UTC")
+	assert.Nil(t, err)
+	assert.True(t, noon.Equal(connectTime), connectTime.String())
+
+	// An abbreviation unknown to the zone uses the wall clock time
+	connectTime, err = parseConnectTime("2024-01-01 12:00:00 MEZ")
+	assert.Nil(t, err)
+	assert.True(t, noon.Equal(connectTime), connectTime.String())
+
+	_, err = parseConnectTime("yesterday")
+	assert.NotNil(t, err)
+}
+
+func TestServerGroupChurn(t *testing.T) {
+	now := time.Now()
+	previous := newServerGroup("test_1", "app", now)
+	previous.add(Server{State: "idle", Ptr: "0x1"}, 3600)
+	previous.add(Server{State: "idle", Ptr: "0x2"}, 3600)
+
+	current := newServerGroup("test_1", "app", now)
+	current.add(Server{State: "idle", Ptr: "0x2"}, 3600)
+	current.add(Server{State: "active", Ptr: "0x3"}, 3600)
+	current.add(Server{State: "active", Ptr: "0x4"}, 3600)
+
+	opened, closed := current.churn(previous)
+	assert.Equal(t, float64(2), opened)
+	assert.Equal(t, float64(1), closed)
+}
+
+func TestDBServersAddMetricDataRemovedPool(t *testing.T) {
+	now := time.Now()
+	group := newServerGroup("test_1", "app", now)
+	group.add(Server{State: "idle", Ptr: "0x1"}, 3600)
+	previous := DBServers{poolKey{"test_1", "app"}: group}
+
+	metrics := DBServers{}.addMetricData(nil, previous)
+
+	assert.Equal(t, 1, len(metrics))
+	assert.Equal(t, "ServerConnectionsClosed", metrics[0].Name)
+	assert.Equal(t, float64(1), metrics[0].Value)
+	assert.Equal(t, now, metrics[0].TimeStamp)
+
+	// The closed connections are stamped with the current snapshot
+	later := now.Add(time.Minute)
+	current := DBServers{poolKey{"test_1", "migrate"}: newServerGroup("test_1", "migrate", later)}
+	for _, metric := range current.addMetricData(nil, previous) {
+		assert.Equal(t, later, metric.TimeStamp)
+	}
+}
+
+func TestServerGroupPreparedStatements(t *testing.T) {
+	group := newServerGroup("test_1", "app", time.Now())
+	group.add(Server{State: "idle", Ptr: "0x1", PreparedStatements: 3}, 3600)
+	group.add(Server{State: "active", Ptr: "0x2", PreparedStatements: 5}, 3600)
+
+	assert.Equal(t, float64(8), group.PreparedStatements)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Sink ships the metrics generated on each interval to a backend.
+type Sink interface {
+	Name() string
+	Push(metrics []Metric) error
+}
+
+// snapshotSink is implemented by sinks which work on the raw data collected
+// from pgbouncer instead of the per-interval metrics.
+type snapshotSink interface {
+	Observe(t *target, point *statusPoint)
+}
+
+// sinkConfig holds the settings the sink factories can draw from.
+type sinkConfig struct {
+	aws              aws.Config
+	namespace        string
+	prometheusListen string
+	emfOutput        string
+	statsdAddress    string
+	statsdPrefix     string
+	statsdTags       bool
+	otlpEndpoint     string
+	otlpProtocol     string
+}
+
+type sinkFactory func(cfg sinkConfig) (Sink, error)
+
+var sinkFactories = map[string]sinkFactory{
+	"cloudwatch": newCloudWatchSink,
+	"prometheus": newPrometheusSink,
+	"emf":        newEMFSink,
+	"statsd":     newStatsdSink,
+	"otlp":       newOTLPSink,
+}
+
+func newSinks(names []string, cfg sinkConfig) ([]Sink, error) {
+	var sinks []Sink
+	for _, name := range names {
+		factory, ok := sinkFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown sink %q", name)
+		}
+		sink, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create sink %q: %v", name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+func pushMetrics(sinks []Sink, metrics []Metric) {
+	for _, sink := range sinks {
+		if err := sink.Push(metrics); err != nil {
+			log.Printf("Error pushing metrics to %s: %v\n", sink.Name(), err)
+		}
+	}
+}
+
+// observeSnapshot hands the latest collected data of the target to every
+// snapshotSink. A nil point signals that collecting the data failed.
+func observeSnapshot(sinks []Sink, t *target, point *statusPoint) {
+	for _, sink := range sinks {
+		if s, ok := sink.(snapshotSink); ok {
+			s.Observe(t, point)
+		}
+	}
+}
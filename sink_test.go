@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingSink struct {
+	metrics []Metric
+	err     error
+}
+
+func (r *recordingSink) Name() string {
+	return "recording"
+}
+
+func (r *recordingSink) Push(metrics []Metric) error {
+	r.metrics = append(r.metrics, metrics...)
+	return r.err
+}
+
+func TestNewSinks(t *testing.T) {
+	sinks, err := newSinks([]string{"cloudwatch"}, sinkConfig{namespace: "PGBouncer"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(sinks))
+	assert.Equal(t, "cloudwatch", sinks[0].Name())
+}
+
+func TestNewSinksUnknown(t *testing.T) {
+	_, err := newSinks([]string{"cloudwatch", "unknown"}, sinkConfig{})
+	assert.EqualError(t, err, `unknown sink "unknown"`)
+}
+
+func TestPushMetrics(t *testing.T) {
+	first := &recordingSink{err: errors.New("failed")}
+	second := &recordingSink{}
+	metrics := []Metric{
+		newMetric("QueryCount", 10, UnitCountSecond, time.Now(), Dimension{"Database", "test"}),
+	}
+
+	pushMetrics([]Sink{first, second}, metrics)
+
+	assert.Equal(t, metrics, first.metrics)
+	assert.Equal(t, metrics, second.metrics)
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
+	"math"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -16,24 +17,92 @@ type Stats struct {
 	TransactionTime  float64 `db:"xact_time"`
 	BytesReceived    float64 `db:"bytes_received"`
 	BytesSent        float64 `db:"bytes_sent"`
-	PoolStats        Pool
-	TimeStamp        time.Time
-	IsAggregated     bool
+
+	// Available since pgbouncer 1.21, see HasPreparedStatements
+	ServerAssignmentCount float64 `db:"server_assignment_count"`
+	ClientParseCount      float64 `db:"client_parse_count"`
+	ServerParseCount      float64 `db:"server_parse_count"`
+	BindCount             float64 `db:"bind_count"`
+
+	// Extra holds the counters of columns added by newer pgbouncer versions
+	Extra                 map[string]float64 `db:"-"`
+	PoolStats             Pool
+	TimeStamp             time.Time
+	IsAggregated          bool
+	HasPreparedStatements bool
 }
 
 type DBStats map[string]Stats
 
-func (s *DBStats) getDelta(previous DBStats) DBStats {
-	result := make(DBStats)
+// getDelta returns the per second rates since the previous snapshot. When
+// the counters of a database went backwards pgbouncer was restarted (or the
+// database was recreated) in between, the current totals are then used as
+// the delta from zero and reset is set.
+//
+// The rates are combined into an aggregated record for all databases. This
+// is done on the rates instead of the raw totals so databases which are
+// added or removed between the snapshots don't skew the totals.
+func (s *DBStats) getDelta(previous DBStats) (result DBStats, reset bool) {
+	result = make(DBStats)
 
+	var total *Stats
 	for database, stats := range *s {
-		if _, ok := previous[database]; !ok {
+		prev, ok := previous[database]
+		if !ok {
 			continue
 		}
-		result[database] = stats.calculatePerSecond(previous[database])
+		if stats.isReset(prev) {
+			reset = true
+			prev = prev.zeroed()
+		}
+		delta := stats.calculatePerSecond(prev)
+		result[database] = delta
+
+		if total == nil {
+			total = &Stats{IsAggregated: true, TimeStamp: delta.TimeStamp}
+		}
+		total.aggregate(delta)
+	}
+	if total != nil {
+		result[total.Database] = *total
+	}
+	return result, reset
+
+}
+
+// zeroed returns the record with all counters at zero, used as the
+// previous snapshot once pgbouncer was restarted.
+func (s Stats) zeroed() Stats {
+	return Stats{Database: s.Database, TimeStamp: s.TimeStamp}
+}
+
+// zeroed returns the records with all counters at zero.
+func (s DBStats) zeroed() DBStats {
+	result := make(DBStats, len(s))
+	for database, stats := range s {
+		result[database] = stats.zeroed()
 	}
 	return result
+}
 
+// isReset returns true if any of the counters is lower than in p.
+func (s *Stats) isReset(p Stats) bool {
+	for key, value := range s.Extra {
+		if value < p.Extra[key] {
+			return true
+		}
+	}
+	return s.QueryCount < p.QueryCount ||
+		s.QueryTime < p.QueryTime ||
+		s.WaitTime < p.WaitTime ||
+		s.TransactionCount < p.TransactionCount ||
+		s.TransactionTime < p.TransactionTime ||
+		s.BytesReceived < p.BytesReceived ||
+		s.BytesSent < p.BytesSent ||
+		s.ServerAssignmentCount < p.ServerAssignmentCount ||
+		s.ClientParseCount < p.ClientParseCount ||
+		s.ServerParseCount < p.ServerParseCount ||
+		s.BindCount < p.BindCount
 }
 
 func (s *Stats) calculatePerSecond(p Stats) Stats {
@@ -50,7 +119,20 @@ func (s *Stats) calculatePerSecond(p Stats) Stats {
 		BytesReceived:    calcDurationDelta(s.BytesReceived, p.BytesReceived, duration),
 		BytesSent:        calcDurationDelta(s.BytesSent, p.BytesSent, duration),
 
-		IsAggregated: s.IsAggregated,
+		IsAggregated:          s.IsAggregated,
+		HasPreparedStatements: s.HasPreparedStatements,
+	}
+	if s.HasPreparedStatements {
+		result.ServerAssignmentCount = calcDurationDelta(s.ServerAssignmentCount, p.ServerAssignmentCount, duration)
+		result.ClientParseCount = calcDurationDelta(s.ClientParseCount, p.ClientParseCount, duration)
+		result.ServerParseCount = calcDurationDelta(s.ServerParseCount, p.ServerParseCount, duration)
+		result.BindCount = calcDurationDelta(s.BindCount, p.BindCount, duration)
+	}
+	for key, value := range s.Extra {
+		if result.Extra == nil {
+			result.Extra = make(map[string]float64, len(s.Extra))
+		}
+		result.Extra[key] = calcDurationDelta(value, p.Extra[key], duration)
 	}
 	// Calculate the times based on the number of hits, conver to milliseconds.
 	if queryCount > 0 {
@@ -66,101 +148,180 @@ func calcDurationDelta(cur float64, prev float64, duration int64) float64 {
 	return ((cur - prev) / float64(duration)) * float64(time.Second)
 }
 
-func (s *Stats) add(o Stats) {
-	s.QueryCount += o.QueryCount
-	s.QueryTime += o.QueryTime
-	s.WaitTime += o.WaitTime
-	s.TransactionCount += o.TransactionCount
-	s.TransactionTime += o.TransactionTime
-	s.BytesReceived += o.BytesReceived
-	s.BytesSent += o.BytesSent
+// statsAggregations declares how the per second stats of the databases are
+// combined. The times are averages per query or transaction so they are
+// weighted by the matching count.
+var statsAggregations = map[string]aggregation{
+	"QueryCount":       aggregateSum,
+	"QueryTime":        aggregateWeightedAverage,
+	"WaitTime":         aggregateSum,
+	"TransactionCount": aggregateSum,
+	"TransactionTime":  aggregateWeightedAverage,
+	"BytesReceived":    aggregateSum,
+	"BytesSent":        aggregateSum,
+
+	"ServerAssignmentCount": aggregateSum,
+	"ClientParseCount":      aggregateSum,
+	"ServerParseCount":      aggregateSum,
+	"BindCount":             aggregateSum,
+}
+
+// aggregate combines the per second stats o into s using statsAggregations.
+func (s *Stats) aggregate(o Stats) {
+	// The times are weighted by the counts, so update them first.
+	s.QueryTime = statsAggregations["QueryTime"].aggregate(
+		s.QueryTime, s.QueryCount, o.QueryTime, o.QueryCount)
+	s.TransactionTime = statsAggregations["TransactionTime"].aggregate(
+		s.TransactionTime, s.TransactionCount, o.TransactionTime, o.TransactionCount)
+
+	s.QueryCount = statsAggregations["QueryCount"].aggregate(s.QueryCount, 0, o.QueryCount, 0)
+	s.WaitTime = statsAggregations["WaitTime"].aggregate(s.WaitTime, 0, o.WaitTime, 0)
+	s.TransactionCount = statsAggregations["TransactionCount"].aggregate(
+		s.TransactionCount, 0, o.TransactionCount, 0)
+	s.BytesReceived = statsAggregations["BytesReceived"].aggregate(s.BytesReceived, 0, o.BytesReceived, 0)
+	s.BytesSent = statsAggregations["BytesSent"].aggregate(s.BytesSent, 0, o.BytesSent, 0)
+
+	s.ServerAssignmentCount = statsAggregations["ServerAssignmentCount"].aggregate(
+		s.ServerAssignmentCount, 0, o.ServerAssignmentCount, 0)
+	s.ClientParseCount = statsAggregations["ClientParseCount"].aggregate(
+		s.ClientParseCount, 0, o.ClientParseCount, 0)
+	s.ServerParseCount = statsAggregations["ServerParseCount"].aggregate(
+		s.ServerParseCount, 0, o.ServerParseCount, 0)
+	s.BindCount = statsAggregations["BindCount"].aggregate(s.BindCount, 0, o.BindCount, 0)
+	s.HasPreparedStatements = s.HasPreparedStatements || o.HasPreparedStatements
+
+	// The extra columns are all counters
+	s.Extra = addExtra(s.Extra, o.Extra)
+}
+
+// preparedStatementHitRatio returns the percentage of the prepared
+// statements parsed by clients which were served from the cache instead of
+// being parsed by the server.
+func (s *Stats) preparedStatementHitRatio() float64 {
+	if s.ClientParseCount <= 0 {
+		return 0
+	}
+	return math.Max(0, (s.ClientParseCount-s.ServerParseCount)*100/s.ClientParseCount)
 }
 
 func (s *Stats) isEmpty() bool {
 	return s.QueryCount == 0 && s.TransactionCount == 0 && s.WaitTime == 0
 }
 
-func (s *Stats) addMetricData(dest []cloudwatch.MetricDatum) []cloudwatch.MetricDatum {
+func (s *Stats) addMetricData(dest []Metric) []Metric {
 	if s.isEmpty() {
 		return dest
 	}
 
-	items := map[string]struct {
-		value float64
-		unit  cloudwatch.StandardUnit
-	}{
-		"QueryCount": {s.QueryCount, cloudwatch.StandardUnitCountSecond},
-		"QueryTime":  {s.QueryTime, cloudwatch.StandardUnitMilliseconds},
-		"WaitTime":   {s.WaitTime, cloudwatch.StandardUnitMilliseconds},
+	items := map[string]metricValue{
+		"QueryCount":       {s.QueryCount, UnitCountSecond},
+		"QueryTime":        {s.QueryTime, UnitMilliseconds},
+		"WaitTime":         {s.WaitTime, UnitMilliseconds},
+		"TransactionCount": {s.TransactionCount, UnitCountSecond},
+		"TransactionTime":  {s.TransactionTime, UnitMilliseconds},
+		"BytesReceived":    {s.BytesReceived, UnitBytesSecond},
+		"BytesSent":        {s.BytesSent, UnitBytesSecond},
 	}
 
-	metricItems := []string{"QueryCount", "QueryTime"}
+	metricItems := []string{
+		"QueryCount", "QueryTime", "TransactionCount", "TransactionTime",
+		"BytesReceived", "BytesSent",
+	}
 	if metadata.detailedMonitoring {
 		metricItems = append(metricItems, "WaitTime")
 	}
+	if s.HasPreparedStatements {
+		items["ServerAssignmentCount"] = metricValue{s.ServerAssignmentCount, UnitCountSecond}
+		items["ClientParseCount"] = metricValue{s.ClientParseCount, UnitCountSecond}
+		items["ServerParseCount"] = metricValue{s.ServerParseCount, UnitCountSecond}
+		items["BindCount"] = metricValue{s.BindCount, UnitCountSecond}
+		metricItems = append(metricItems,
+			"ServerAssignmentCount", "ClientParseCount", "ServerParseCount", "BindCount")
+		if s.ClientParseCount > 0 {
+			items["PreparedStatementHitRatio"] = metricValue{s.preparedStatementHitRatio(), UnitPercent}
+			metricItems = append(metricItems, "PreparedStatementHitRatio")
+		}
+	}
+	for _, key := range sortedExtraKeys(s.Extra) {
+		name := columnMetricName(key)
+		items[name] = metricValue{s.Extra[key], UnitCountSecond}
+		metricItems = append(metricItems, name)
+	}
 
 	if s.IsAggregated {
-		dimension := cloudwatch.Dimension{
-			Name:  stringPtr("Across all instances"),
-			Value: stringPtr("instances"),
-		}
+		dimension := Dimension{Name: "Across all instances", Value: "instances"}
 		for _, key := range metricItems {
-			dest = append(dest, s.createMetricDatum(key, items[key].value, items[key].unit, dimension))
+			dest = append(dest, newMetric(key, items[key].value, items[key].unit, s.TimeStamp, dimension))
 		}
 
-		dimension = cloudwatch.Dimension{
-			Name:  stringPtr("InstanceId"),
-			Value: stringPtr(metadata.InstanceID),
-		}
+		dimension = Dimension{Name: "InstanceId", Value: metadata.InstanceID}
 		for _, key := range metricItems {
-			dest = append(dest, s.createMetricDatum(key, items[key].value, items[key].unit, dimension))
+			dest = append(dest, newMetric(key, items[key].value, items[key].unit, s.TimeStamp, dimension))
 		}
 	} else {
-		dimension := cloudwatch.Dimension{
-			Name:  stringPtr("Database"),
-			Value: stringPtr(s.Database),
-		}
-
+		dimension := Dimension{Name: "Database", Value: s.Database}
 		for _, key := range metricItems {
-			dest = append(dest, s.createMetricDatum(key, items[key].value, items[key].unit, dimension))
+			dest = append(dest, newMetric(key, items[key].value, items[key].unit, s.TimeStamp, dimension))
 		}
 	}
 	return dest
 }
 
-func (s *Stats) createMetricDatum(
-	name string,
-	value float64,
-	unit cloudwatch.StandardUnit,
-	dimension cloudwatch.Dimension,
-) cloudwatch.MetricDatum {
-	return cloudwatch.MetricDatum{
-		MetricName: &name,
-		Dimensions: []cloudwatch.Dimension{dimension},
-		Timestamp:  &s.TimeStamp,
-		Unit:       unit,
-		Value:      &value,
-	}
+// legacyStats holds the SHOW STATS columns of pgbouncer versions before
+// SHOW STATS_TOTALS was added.
+type legacyStats struct {
+	Database  string  `db:"database"`
+	Requests  float64 `db:"total_requests"`
+	Received  float64 `db:"total_received"`
+	Sent      float64 `db:"total_sent"`
+	QueryTime float64 `db:"total_query_time"`
 }
 
-func getStatsData(db *sqlx.DB) (DBStats, error) {
+func getStatsData(ctx context.Context, db *sqlx.DB, version pgbouncerVersion) (DBStats, error) {
 	var stats []Stats
-	err := db.Select(&stats, `SHOW STATS_TOTALS`)
+	var err error
+	if version.atLeast(statsTotalsVersion) {
+		err = selectColumns(ctx, db, `SHOW STATS_TOTALS`, func(row columnValues) {
+			var item Stats
+			item.Extra = row.assign(db, &item)
+			item.HasPreparedStatements = version.atLeast(preparedStatementsVersion)
+			stats = append(stats, item)
+		})
+	} else {
+		stats, err = getLegacyStatsData(ctx, db)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	dbStats := make(DBStats)
-	total := Stats{IsAggregated: true, TimeStamp: time.Now()}
 	for _, item := range stats {
 		if item.Database == "pgbouncer" {
 			continue
 		}
 
 		item.TimeStamp = time.Now()
-		total.add(item)
 		dbStats[item.Database] = item
 	}
-	dbStats[total.Database] = total
 	return dbStats, nil
 }
+
+func getLegacyStatsData(ctx context.Context, db *sqlx.DB) ([]Stats, error) {
+	var legacy []legacyStats
+	err := selectContext(ctx, db.Unsafe(), &legacy, `SHOW STATS`)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]Stats, len(legacy))
+	for i, item := range legacy {
+		stats[i] = Stats{
+			Database:      item.Database,
+			QueryCount:    item.Requests,
+			QueryTime:     item.QueryTime,
+			BytesReceived: item.Received,
+			BytesSent:     item.Sent,
+		}
+	}
+	return stats, nil
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"testing"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/jmoiron/sqlx"
 	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
 
@@ -30,7 +30,7 @@ func TestGetStatsData(t *testing.T) {
 
 	sqlxDB := sqlx.NewDb(db, "sqlmock")
 
-	stats, err := getStatsData(sqlxDB)
+	stats, err := getStatsData(context.Background(), sqlxDB, statsTotalsVersion)
 	assert.Equal(t, nil, err)
 
 	expected := DBStats{
@@ -58,18 +58,7 @@ func TestGetStatsData(t *testing.T) {
 			TimeStamp:        stats["test_2"].TimeStamp,
 			IsAggregated:     false,
 		},
-		"": Stats{
-			Database:         "",
-			QueryCount:       250,
-			QueryTime:        33000,
-			WaitTime:         2400,
-			TransactionCount: 2,
-			TransactionTime:  30400,
-			BytesReceived:    2304,
-			BytesSent:        4608,
-			TimeStamp:        stats[""].TimeStamp,
-			IsAggregated:     true,
-		}}
+	}
 
 	assert.Equal(t, expected, stats)
 }
@@ -160,7 +149,7 @@ func TestStatsDeltaNoActivity(t *testing.T) {
 	assert.Equal(t, expected, delta)
 }
 
-func TestStatsAdd(t *testing.T) {
+func TestStatsAggregate(t *testing.T) {
 
 	current := Stats{
 		Database:         "test",
@@ -176,25 +165,25 @@ func TestStatsAdd(t *testing.T) {
 
 	other := Stats{
 		Database:         "test",
-		QueryCount:       100,
-		QueryTime:        200,
+		QueryCount:       300,
+		QueryTime:        100,
 		WaitTime:         300,
-		TransactionCount: 400,
-		TransactionTime:  500,
+		TransactionCount: 100,
+		TransactionTime:  1000,
 		BytesReceived:    600,
 		BytesSent:        700,
 		TimeStamp:        time.Now(),
 	}
 
-	current.add(other)
+	current.aggregate(other)
 
 	expected := Stats{
 		Database:         "test",
-		QueryCount:       200,
-		QueryTime:        400,
+		QueryCount:       400,
+		QueryTime:        125,
 		WaitTime:         600,
-		TransactionCount: 800,
-		TransactionTime:  1000,
+		TransactionCount: 500,
+		TransactionTime:  600,
 		BytesReceived:    1200,
 		BytesSent:        1400,
 		TimeStamp:        current.TimeStamp,
@@ -232,7 +221,7 @@ func TestStatsAddMetricData(t *testing.T) {
 		TimeStamp:        time.Now(),
 	}
 
-	metrics := []cloudwatch.MetricDatum{}
+	metrics := []Metric{}
 	instance.addMetricData(metrics)
 }
 
@@ -250,7 +239,7 @@ func TestStatsAddMetricDataAggregated(t *testing.T) {
 		IsAggregated:     true,
 	}
 
-	metrics := []cloudwatch.MetricDatum{}
+	metrics := []Metric{}
 	instance.addMetricData(metrics)
 }
 
@@ -268,6 +257,217 @@ func TestStatsAddMetricDataEmpty(t *testing.T) {
 		IsAggregated:     true,
 	}
 
-	metrics := []cloudwatch.MetricDatum{}
+	metrics := []Metric{}
 	instance.addMetricData(metrics)
 }
+
+func TestStatsAddMetricDataUnits(t *testing.T) {
+	metadata.detailedMonitoring = false
+	instance := Stats{
+		Database:         "test",
+		QueryCount:       10,
+		QueryTime:        2,
+		TransactionCount: 5,
+		TransactionTime:  4,
+		BytesReceived:    1024,
+		BytesSent:        2048,
+		TimeStamp:        time.Now(),
+	}
+
+	metrics := instance.addMetricData(nil)
+
+	units := make(map[string]Unit)
+	for _, metric := range metrics {
+		units[metric.Name] = metric.Unit
+	}
+	assert.Equal(t, map[string]Unit{
+		"QueryCount":       UnitCountSecond,
+		"QueryTime":        UnitMilliseconds,
+		"TransactionCount": UnitCountSecond,
+		"TransactionTime":  UnitMilliseconds,
+		"BytesReceived":    UnitBytesSecond,
+		"BytesSent":        UnitBytesSecond,
+	}, units)
+}
+
+func TestStatsGetDeltaReset(t *testing.T) {
+	now := time.Now()
+	previous := DBStats{
+		"test": Stats{
+			Database:         "test",
+			QueryCount:       1000,
+			QueryTime:        5000,
+			TransactionCount: 1000,
+			TransactionTime:  5000,
+			TimeStamp:        now.Add(-10 * time.Second),
+		},
+	}
+	current := DBStats{
+		"test": Stats{
+			Database:         "test",
+			QueryCount:       20,
+			QueryTime:        40000,
+			TransactionCount: 20,
+			TransactionTime:  40000,
+			TimeStamp:        now,
+		},
+	}
+
+	delta, reset := current.getDelta(previous)
+
+	assert.True(t, reset)
+	assert.Equal(t, float64(2), delta["test"].QueryCount)
+	assert.Equal(t, float64(2), delta["test"].QueryTime)
+	assert.Equal(t, float64(2), delta["test"].TransactionCount)
+}
+
+func TestStatsGetDeltaNoReset(t *testing.T) {
+	now := time.Now()
+	previous := DBStats{
+		"test": Stats{Database: "test", QueryCount: 10, TimeStamp: now.Add(-10 * time.Second)},
+	}
+	current := DBStats{
+		"test": Stats{Database: "test", QueryCount: 30, TimeStamp: now},
+		"new":  Stats{Database: "new", QueryCount: 30, TimeStamp: now},
+	}
+
+	delta, reset := current.getDelta(previous)
+
+	assert.False(t, reset)
+	assert.Equal(t, 2, len(delta))
+	assert.Equal(t, float64(2), delta["test"].QueryCount)
+}
+
+func TestStatsGetDeltaAggregated(t *testing.T) {
+	now := time.Now()
+	previous := DBStats{
+		"test_1": Stats{Database: "test_1", TimeStamp: now.Add(-10 * time.Second)},
+		"test_2": Stats{Database: "test_2", TimeStamp: now.Add(-10 * time.Second)},
+	}
+	current := DBStats{
+		"test_1": Stats{Database: "test_1", QueryCount: 10, QueryTime: 10000, TimeStamp: now},
+		"test_2": Stats{Database: "test_2", QueryCount: 30, QueryTime: 150000, TimeStamp: now},
+		// Added after the previous snapshot, must not end up in the totals
+		"test_3": Stats{Database: "test_3", QueryCount: 5000, QueryTime: 5000, TimeStamp: now},
+	}
+
+	delta, _ := current.getDelta(previous)
+
+	total := delta[""]
+	assert.True(t, total.IsAggregated)
+	assert.Equal(t, float64(4), total.QueryCount)
+	assert.Equal(t, float64(4), total.QueryTime)
+}
+
+func TestGetStatsDataExtraColumns(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{
+		"database", "server_assignment_count", "xact_count", "query_count", "bytes_received",
+		"bytes_sent", "xact_time", "query_time", "wait_time", "client_parse_count",
+		"server_parse_count", "bind_count", "future_count",
+	}).
+		AddRow("test_1", 50, 1, 100, 256, 512, 15000, 15000, 1200, 40, 10, 80, 7)
+	mock.ExpectQuery("SHOW STATS_TOTALS").WillReturnRows(rows)
+
+	stats, err := getStatsData(context.Background(), sqlx.NewDb(db, "sqlmock"), pgbouncerVersion{1, 21, 0})
+	assert.Nil(t, err)
+
+	item := stats["test_1"]
+	assert.Equal(t, float64(100), item.QueryCount)
+	assert.Equal(t, float64(50), item.ServerAssignmentCount)
+	assert.Equal(t, float64(40), item.ClientParseCount)
+	assert.Equal(t, float64(10), item.ServerParseCount)
+	assert.Equal(t, float64(80), item.BindCount)
+	assert.True(t, item.HasPreparedStatements)
+
+	// Columns unknown to this version are kept as extra counters
+	assert.Equal(t, map[string]float64{"future_count": 7}, item.Extra)
+}
+
+func TestStatsPreparedStatements(t *testing.T) {
+	now := time.Now()
+	current := Stats{
+		QueryCount:            10,
+		ServerAssignmentCount: 200,
+		ClientParseCount:      100,
+		ServerParseCount:      10,
+		BindCount:             300,
+		HasPreparedStatements: true,
+		TimeStamp:             now,
+	}
+	previous := Stats{
+		ServerAssignmentCount: 100,
+		ClientParseCount:      60,
+		ServerParseCount:      6,
+		BindCount:             100,
+		HasPreparedStatements: true,
+		TimeStamp:             now.Add(-10 * time.Second),
+	}
+
+	delta := current.calculatePerSecond(previous)
+	assert.Equal(t, float64(10), delta.ServerAssignmentCount)
+	assert.Equal(t, float64(4), delta.ClientParseCount)
+	assert.Equal(t, 0.4, delta.ServerParseCount)
+	assert.Equal(t, float64(20), delta.BindCount)
+	assert.Equal(t, float64(90), delta.preparedStatementHitRatio())
+
+	metadata.detailedMonitoring = false
+	values := make(map[string]float64)
+	for _, metric := range delta.addMetricData(nil) {
+		values[metric.Name] = metric.Value
+	}
+	assert.Equal(t, float64(90), values["PreparedStatementHitRatio"])
+	assert.Equal(t, float64(20), values["BindCount"])
+}
+
+func TestGetStatsDataLegacy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{
+		"database", "total_requests", "total_received", "total_sent", "total_query_time",
+		"avg_req", "avg_recv", "avg_sent", "avg_query",
+	}).
+		AddRow("test_1", 100, 256, 512, 15000, 1, 2, 3, 4)
+	mock.ExpectQuery("SHOW STATS").WillReturnRows(rows)
+
+	stats, err := getStatsData(context.Background(), sqlx.NewDb(db, "sqlmock"), legacyVersion)
+	assert.Nil(t, err)
+
+	expected := DBStats{
+		"test_1": Stats{
+			Database:      "test_1",
+			QueryCount:    100,
+			QueryTime:     15000,
+			BytesReceived: 256,
+			BytesSent:     512,
+			TimeStamp:     stats["test_1"].TimeStamp,
+		},
+	}
+	assert.Equal(t, expected, stats)
+}
+
+func TestStatsDeltaExtra(t *testing.T) {
+	now := time.Now()
+	current := Stats{QueryCount: 10, Extra: map[string]float64{"total_bind_count": 30}, TimeStamp: now}
+	previous := Stats{Extra: map[string]float64{"total_bind_count": 10}, TimeStamp: now.Add(-10 * time.Second)}
+
+	delta := current.calculatePerSecond(previous)
+	assert.Equal(t, map[string]float64{"total_bind_count": 2}, delta.Extra)
+	assert.Equal(t, float64(0), delta.BindCount)
+	assert.False(t, current.isReset(previous))
+	assert.True(t, previous.isReset(current))
+
+	metadata.detailedMonitoring = false
+	metrics := delta.addMetricData(nil)
+	assert.Equal(t, "BindCount", metrics[len(metrics)-1].Name)
+	assert.Equal(t, UnitCountSecond, metrics[len(metrics)-1].Unit)
+}
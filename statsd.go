@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The maximum payload of a single datagram, small enough to avoid
+// fragmentation on UDP and the default buffer of the DogStatsD socket.
+const (
+	statsdUDPPacketSize  = 1432
+	statsdUnixPacketSize = 8192
+)
+
+// statsdSink sends the metrics to a StatsD agent, the
+// dimensions are added as DogStatsD tags or to the metric name.
+type statsdSink struct {
+	conn       net.Conn
+	packetSize int
+	prefix     string
+	tags       bool
+}
+
+var statsdReplacer = strings.NewReplacer(" ", "_", ":", "_", "|", "_", ",", "_", "#", "_", "@", "_")
+
+// statsdNameReplacer also replaces the separators of the metric hierarchy,
+// for dimension values which become part of the name.
+var statsdNameReplacer = strings.NewReplacer(" ", "_", ":", "_", "|", "_", ",", "_", "#", "_", "@", "_", ".", "_", "/", "_")
+
+func newStatsdSink(cfg sinkConfig) (Sink, error) {
+	network, address := "udp", cfg.statsdAddress
+	packetSize := statsdUDPPacketSize
+	if strings.HasPrefix(address, "unix://") {
+		network, address = "unixgram", strings.TrimPrefix(address, "unix://")
+		packetSize = statsdUnixPacketSize
+	}
+	address = strings.TrimPrefix(address, "udp://")
+
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{
+		conn:       conn,
+		packetSize: packetSize,
+		prefix:     cfg.statsdPrefix,
+		tags:       cfg.statsdTags,
+	}, nil
+}
+
+func (s *statsdSink) Name() string {
+	return "statsd"
+}
+
+func (s *statsdSink) Push(metrics []Metric) error {
+	var lastErr error
+	var packet bytes.Buffer
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			lastErr = err
+		}
+		packet.Reset()
+	}
+
+	for _, metric := range metrics {
+		line := s.format(metric)
+		if packet.Len() > 0 && packet.Len()+1+len(line) > s.packetSize {
+			flush()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	flush()
+	return lastErr
+}
+
+// format returns the metric in the StatsD line protocol. Events are sent as
+// counters, everything else including the rates as gauges.
+func (s *statsdSink) format(metric Metric) string {
+	name := s.prefix + metric.Name
+	var tags []string
+	for _, dimension := range metric.Dimensions {
+		if s.tags {
+			tags = append(tags, statsdReplacer.Replace(strings.ToLower(dimension.Name))+":"+
+				statsdReplacer.Replace(dimension.Value))
+		} else {
+			name += "." + statsdNameReplacer.Replace(dimension.Value)
+		}
+	}
+
+	kind := "g"
+	if stringInSlice(metric.Name, countMetricNames) {
+		kind = "c"
+	}
+	line := name + ":" + strconv.FormatFloat(metric.Value, 'f', -1, 64) + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
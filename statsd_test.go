@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsdFormat(t *testing.T) {
+	metric := newMetric("QueryCount", 12.5, UnitCountSecond, time.Now(),
+		Dimension{Name: "Database", Value: "test_1"},
+		Dimension{Name: "Across all instances", Value: "instances"})
+
+	sink := &statsdSink{prefix: "pgbouncer.", tags: true}
+	assert.Equal(t, "pgbouncer.QueryCount:12.5|g|#database:test_1,across_all_instances:instances", sink.format(metric))
+
+	sink.tags = false
+	assert.Equal(t, "pgbouncer.QueryCount.test_1.instances:12.5|g", sink.format(metric))
+
+	assert.Equal(t, "pgbouncer.Restarts:1|c", sink.format(newMetric("Restarts", 1, UnitCount, time.Now())))
+
+	subnet := newMetric("ClientConnections", 3, UnitCount, time.Now(),
+		Dimension{Name: "Database", Value: "app.prod"}, Dimension{Name: "Subnet", Value: "10.0.1.0/24"})
+	assert.Equal(t, "pgbouncer.ClientConnections.app_prod.10_0_1_0_24:3|g", sink.format(subnet))
+
+	sink.tags = true
+	assert.Equal(t, "pgbouncer.ClientConnections:3|g|#database:app.prod,subnet:10.0.1.0/24", sink.format(subnet))
+}
+
+func TestStatsdSinkPush(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	sink, err := newStatsdSink(sinkConfig{statsdAddress: listener.LocalAddr().String(), statsdTags: true})
+	assert.Nil(t, err)
+	s := sink.(*statsdSink)
+	s.packetSize = 40
+
+	dimension := Dimension{Name: "InstanceId", Value: "i-1"}
+	assert.Nil(t, sink.Push([]Metric{
+		newMetric("UsedClients", 3, UnitCount, time.Now(), dimension),
+		newMetric("FreeClients", 7, UnitCount, time.Now(), dimension),
+	}))
+
+	buffer := make([]byte, 1024)
+	var packets []string
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, string(buffer[:n]))
+	}
+	assert.Equal(t, []string{
+		"UsedClients:3|g|#instanceid:i-1",
+		"FreeClients:7|g|#instanceid:i-1",
+	}, packets)
+
+	// Both lines fit into a single packet
+	s.packetSize = statsdUDPPacketSize
+	assert.Nil(t, sink.Push([]Metric{
+		newMetric("UsedClients", 3, UnitCount, time.Now(), dimension),
+		newMetric("FreeClients", 7, UnitCount, time.Now(), dimension),
+	}))
+	n, _, err := listener.ReadFrom(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(strings.Split(string(buffer[:n]), "\n")))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+)
+
+// target is a single pgbouncer instance to collect the metrics of. The
+// name is published as the Target dimension, together with the optional
+// extra dimensions. A target without a name (when only --url is given)
+// doesn't add any dimensions.
+type target struct {
+	Name       string
+	URL        string
+	Dimensions []Dimension
+	status     statusLog
+
+	// The long-lived admin connection and the samples since the last
+	// scrape, only used by the scrape or sample which holds busy.
+	db            *sqlx.DB
+	version       pgbouncerVersion
+	busy          int32
+	backoff       time.Duration
+	nextReconnect time.Time
+	samples       metricSamples
+
+	// The average query time of the last interval, the baseline of the
+	// burst trigger.
+	queryTime float64
+}
+
+// dimensions returns the dimensions added to every metric of the target.
+func (t *target) dimensions() []Dimension {
+	if t.Name == "" {
+		return nil
+	}
+	result := []Dimension{{Name: "Target", Value: t.Name}}
+	return append(result, t.Dimensions...)
+}
+
+// logf logs the message prefixed with the name of the target.
+func (t *target) logf(format string, args ...interface{}) {
+	if t.Name != "" {
+		format = "[" + t.Name + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// unixSocket returns true if lib/pq connects to the target over a unix
+// socket, when the host (or PGHOST) is a directory.
+func (t *target) unixSocket() bool {
+	var host string
+	if strings.Contains(t.URL, "://") {
+		u, err := url.Parse(t.URL)
+		if err != nil {
+			return false
+		}
+		host = u.Query().Get("host")
+		if host == "" {
+			host = u.Hostname()
+		}
+	} else {
+		for _, field := range strings.Fields(t.URL) {
+			if key, val, ok := splitKeyValue(field); ok && key == "host" {
+				host = val
+			}
+		}
+	}
+	if host == "" {
+		host = os.Getenv("PGHOST")
+	}
+	return strings.HasPrefix(host, "/")
+}
+
+// tryAcquire marks the target as busy, returns false if a previous scrape is
+// still running.
+func (t *target) tryAcquire() bool {
+	return atomic.CompareAndSwapInt32(&t.busy, 0, 1)
+}
+
+func (t *target) release() {
+	atomic.StoreInt32(&t.busy, 0)
+}
+
+// connection returns the admin connection, checking the health of an
+// existing connection and reconnecting with an exponential backoff.
+func (t *target) connection(ctx context.Context) (*sqlx.DB, error) {
+	if t.db != nil {
+		if err := t.db.PingContext(ctx); err == nil {
+			return t.db, nil
+		}
+		t.logf("Admin connection is unhealthy, reconnecting")
+		t.disconnect()
+	}
+
+	now := time.Now()
+	if now.Before(t.nextReconnect) {
+		return nil, fmt.Errorf("waiting %s before reconnecting", t.nextReconnect.Sub(now).Round(time.Second))
+	}
+
+	db, err := newDB(ctx, t.URL)
+	if err != nil {
+		t.backoff *= 2
+		if t.backoff < minReconnectBackoff {
+			t.backoff = minReconnectBackoff
+		}
+		if t.backoff > maxReconnectBackoff {
+			t.backoff = maxReconnectBackoff
+		}
+		t.nextReconnect = now.Add(t.backoff)
+		return nil, err
+	}
+
+	version, err := getVersion(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if version != t.version {
+		t.logf("Connected to PgBouncer %s", version)
+	}
+
+	t.backoff = 0
+	t.db = db
+	t.version = version
+	return db, nil
+}
+
+func (t *target) disconnect() {
+	if t.db != nil {
+		t.db.Close()
+		t.db = nil
+	}
+}
+
+// scrape retrieves the current data of the target. The connection is
+// dropped on errors since a cancelled query leaves it in an unknown state.
+func (t *target) scrape(ctx context.Context) (*statusPoint, error) {
+	// Every scrape starts a new sampling interval, also when it fails.
+	samples := t.samples
+	t.samples = nil
+
+	db, err := t.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	point, err := getData(ctx, db, t.version)
+	if err != nil {
+		t.disconnect()
+		return nil, err
+	}
+	point.samples = samples
+	return point, nil
+}
+
+// parseTarget parses a target in the form
+// <name>=<url>[;<dimension>=<value>...].
+func parseTarget(value string) (*target, error) {
+	parts := strings.Split(value, ";")
+	name, url, ok := splitKeyValue(parts[0])
+	if !ok || name == "" || url == "" {
+		return nil, fmt.Errorf("invalid target %q, expected <name>=<url>", value)
+	}
+
+	result := &target{Name: name, URL: url}
+	for _, part := range parts[1:] {
+		key, val, ok := splitKeyValue(part)
+		// CloudWatch rejects dimensions without a value
+		if !ok || key == "" || val == "" {
+			return nil, fmt.Errorf("invalid dimension %q for target %q", part, name)
+		}
+		label := prometheusLabelName(key)
+		if stringInSlice(label, reservedLabels) {
+			return nil, fmt.Errorf("dimension %q for target %q clashes with the built-in label %q", key, name, label)
+		}
+		for _, existing := range result.Dimensions {
+			if prometheusLabelName(existing.Name) == label {
+				return nil, fmt.Errorf("duplicate dimension %q for target %q", key, name)
+			}
+		}
+		result.Dimensions = append(result.Dimensions, Dimension{Name: key, Value: val})
+	}
+	return result, nil
+}
+
+func splitKeyValue(value string) (string, string, bool) {
+	i := strings.Index(value, "=")
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:]), true
+}
+
+// targetList is a flag.Value collecting the targets, it can be passed
+// multiple times or contain whitespace separated targets.
+type targetList []*target
+
+func (l *targetList) String() string {
+	names := make([]string, len(*l))
+	for i, t := range *l {
+		names[i] = t.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *targetList) Set(value string) error {
+	for _, item := range strings.Fields(value) {
+		t, err := parseTarget(item)
+		if err != nil {
+			return err
+		}
+		for _, existing := range *l {
+			if existing.Name == t.Name {
+				return fmt.Errorf("duplicate target %q", t.Name)
+			}
+		}
+		*l = append(*l, t)
+	}
+	return nil
+}
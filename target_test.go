@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestParseTarget(t *testing.T) {
+	result, err := parseTarget("tenant_a=postgresql://pgbouncer@:6433/pgbouncer?host=/tmp;Tenant=a;Env=prod")
+	assert.Nil(t, err)
+	assert.Equal(t, &target{
+		Name: "tenant_a",
+		URL:  "postgresql://pgbouncer@:6433/pgbouncer?host=/tmp",
+		Dimensions: []Dimension{
+			{Name: "Tenant", Value: "a"},
+			{Name: "Env", Value: "prod"},
+		},
+	}, result)
+	assert.Equal(t, []Dimension{
+		{Name: "Target", Value: "tenant_a"},
+		{Name: "Tenant", Value: "a"},
+		{Name: "Env", Value: "prod"},
+	}, result.dimensions())
+}
+
+func TestParseTargetInvalid(t *testing.T) {
+	_, err := parseTarget("postgresql://pgbouncer@:6433/pgbouncer")
+	assert.NotNil(t, err)
+
+	_, err = parseTarget("a=postgresql://pgbouncer@:6433/pgbouncer;Tenant")
+	assert.NotNil(t, err)
+
+	_, err = parseTarget("a=postgresql://pgbouncer@:6433/pgbouncer;az=")
+	assert.EqualError(t, err, `invalid dimension "az=" for target "a"`)
+
+	_, err = parseTarget("a=postgresql://pgbouncer@:6433/pgbouncer;Database=app")
+	assert.EqualError(t, err, `dimension "Database" for target "a" clashes with the built-in label "database"`)
+
+	_, err = parseTarget("a=postgresql://pgbouncer@:6433/pgbouncer;az-name=a;AZ_name=b")
+	assert.EqualError(t, err, `duplicate dimension "AZ_name" for target "a"`)
+}
+
+func TestTargetLabels(t *testing.T) {
+	result, err := parseTarget("a=postgresql://pgbouncer@:6433/pgbouncer;az-name=eu-west-1a;1st.tier=yes")
+	assert.Nil(t, err)
+	assert.Equal(t, []Dimension{
+		{Name: "target", Value: "a"},
+		{Name: "az_name", Value: "eu-west-1a"},
+		{Name: "_1st_tier", Value: "yes"},
+	}, targetLabels(result))
+}
+
+func TestTargetListSet(t *testing.T) {
+	var targets targetList
+	assert.Nil(t, targets.Set("a=postgresql://:6432/pgbouncer b=postgresql://:6433/pgbouncer"))
+	assert.Nil(t, targets.Set("c=postgresql://:6434/pgbouncer"))
+	assert.Equal(t, "a,b,c", targets.String())
+
+	assert.NotNil(t, targets.Set("a=postgresql://:6435/pgbouncer"))
+}
+
+func TestTargetWithoutName(t *testing.T) {
+	result := target{URL: "postgresql://:6432/pgbouncer"}
+	assert.Nil(t, result.dimensions())
+}
+
+func TestTargetUnixSocket(t *testing.T) {
+	os.Unsetenv("PGHOST")
+	assert.True(t, (&target{URL: "postgresql://pgbouncer@:6432/pgbouncer?host=/tmp&sslmode=disable"}).unixSocket())
+	assert.True(t, (&target{URL: "host=/tmp port=6432 dbname=pgbouncer"}).unixSocket())
+	assert.False(t, (&target{URL: "postgresql://pgbouncer@localhost:6432/pgbouncer"}).unixSocket())
+	assert.False(t, (&target{URL: "host=10.0.0.1 port=6432 dbname=pgbouncer"}).unixSocket())
+	assert.False(t, (&target{URL: "postgresql://:6432/pgbouncer"}).unixSocket())
+}
+
+func TestTargetConnectionBackoff(t *testing.T) {
+	result := &target{URL: "mysql://localhost/pgbouncer"}
+
+	_, err := result.connection(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, minReconnectBackoff, result.backoff)
+
+	// The next attempt waits for the backoff to pass
+	_, err = result.connection(context.Background())
+	assert.Contains(t, err.Error(), "before reconnecting")
+
+	result.nextReconnect = time.Time{}
+	result.connection(context.Background())
+	assert.Equal(t, 2*minReconnectBackoff, result.backoff)
+}
+
+func TestTargetScrapeErrorDisconnects(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("SHOW STATS_TOTALS").WillReturnError(errors.New("timeout"))
+	mock.ExpectClose()
+
+	result := &target{db: sqlx.NewDb(db, "sqlmock"), version: statsTotalsVersion}
+	_, err = result.scrape(context.Background())
+
+	assert.EqualError(t, err, "timeout")
+	assert.Nil(t, result.db)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestScrapeTargetsSkipsBusy(t *testing.T) {
+	busy := &target{Name: "busy"}
+	assert.True(t, busy.tryAcquire())
+	assert.False(t, busy.tryAcquire())
+
+	scrapeTargets([]*target{busy})
+	assert.Nil(t, busy.status.current)
+
+	busy.release()
+	assert.True(t, busy.tryAcquire())
+}
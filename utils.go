@@ -1,12 +1,45 @@
 package main
 
+import "strings"
+
 func stringPtr(input string) *string {
 	return &input
 }
 
+func float64Ptr(input float64) *float64 {
+	return &input
+}
+
+func stringInSlice(value string, list []string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
 	}
 	return b
 }
+
+// stringList is a flag.Value which can be passed multiple times, collecting
+// every value. A single value may also contain a comma separated list so it
+// can be set through an environment variable.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type pgbouncerVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+var (
+	// legacyVersion is assumed when SHOW VERSION doesn't return a row,
+	// versions before 1.8 only send it as a notice.
+	legacyVersion = pgbouncerVersion{1, 7, 0}
+
+	// statsTotalsVersion is the first version with SHOW STATS_TOTALS.
+	statsTotalsVersion = pgbouncerVersion{1, 8, 0}
+
+	// preparedStatementsVersion added the prepared statement and server
+	// assignment counters.
+	preparedStatementsVersion = pgbouncerVersion{1, 21, 0}
+)
+
+var versionPattern = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+func (v pgbouncerVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+func (v pgbouncerVersion) atLeast(o pgbouncerVersion) bool {
+	if v.Major != o.Major {
+		return v.Major > o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor > o.Minor
+	}
+	return v.Patch >= o.Patch
+}
+
+func parseVersion(value string) (pgbouncerVersion, error) {
+	match := versionPattern.FindStringSubmatch(value)
+	if match == nil {
+		return pgbouncerVersion{}, fmt.Errorf("unable to parse version %q", value)
+	}
+	var version pgbouncerVersion
+	version.Major, _ = strconv.Atoi(match[1])
+	version.Minor, _ = strconv.Atoi(match[2])
+	version.Patch, _ = strconv.Atoi(match[3])
+	return version, nil
+}
+
+func getVersion(ctx context.Context, db *sqlx.DB) (pgbouncerVersion, error) {
+	var value string
+	err := db.QueryRowxContext(ctx, `SHOW VERSION`).Scan(&value)
+	if err == sql.ErrNoRows {
+		return legacyVersion, nil
+	}
+	if err != nil {
+		return pgbouncerVersion{}, err
+	}
+
+	version, err := parseVersion(value)
+	if err != nil {
+		log.Printf("%v, assuming %s\n", err, statsTotalsVersion)
+		return statsTotalsVersion, nil
+	}
+	return version, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestParseVersion(t *testing.T) {
+	version, err := parseVersion("PgBouncer 1.21.0")
+	assert.Nil(t, err)
+	assert.Equal(t, pgbouncerVersion{1, 21, 0}, version)
+
+	version, err = parseVersion("PgBouncer 1.9")
+	assert.Nil(t, err)
+	assert.Equal(t, pgbouncerVersion{1, 9, 0}, version)
+
+	_, err = parseVersion("PgBouncer")
+	assert.NotNil(t, err)
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	assert.True(t, pgbouncerVersion{1, 8, 0}.atLeast(statsTotalsVersion))
+	assert.True(t, pgbouncerVersion{1, 10, 0}.atLeast(statsTotalsVersion))
+	assert.True(t, pgbouncerVersion{2, 0, 0}.atLeast(statsTotalsVersion))
+	assert.False(t, pgbouncerVersion{1, 7, 2}.atLeast(statsTotalsVersion))
+}
+
+func TestGetVersion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SHOW VERSION").WillReturnRows(
+		sqlmock.NewRows([]string{"version"}).AddRow("PgBouncer 1.21.0"))
+	mock.ExpectQuery("SHOW VERSION").WillReturnRows(sqlmock.NewRows([]string{"version"}))
+
+	version, err := getVersion(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.Equal(t, pgbouncerVersion{1, 21, 0}, version)
+
+	// Old versions only send a notice
+	version, err = getVersion(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.Equal(t, legacyVersion, version)
+}